@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	git2go "github.com/libgit2/git2go/v33"
+)
+
+// checkFileContent returns an error if the file at relPath in the
+// working tree at repoPath does not hold want.
+func checkFileContent(repoPath, relPath string, want []byte) error {
+	got, err := os.ReadFile(filepath.Join(repoPath, relPath))
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", relPath, err)
+	}
+	if !bytes.Equal(got, want) {
+		return contentMismatch(relPath, got, want)
+	}
+	return nil
+}
+
+// contentMismatch returns an error for path holding got instead of
+// want. Large or binary contents are described by their size and blob
+// id rather than quoted.
+func contentMismatch(path string, got, want []byte) error {
+	if len(got)+len(want) > 256 || bytes.IndexByte(got, 0) >= 0 || bytes.IndexByte(want, 0) >= 0 {
+		return fmt.Errorf("content of %s: got %d bytes with blob id %s, want %d bytes with blob id %s",
+			path, len(got), blobID(got), len(want), blobID(want))
+	}
+	return fmt.Errorf("content of %s: got %q, want %q", path, got, want)
+}
+
+// blobID returns the id of a blob holding content, as git hash-object
+// does.
+func blobID(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkBlobContent returns an error if the blob at path in the tree of
+// HEAD does not hold want. It works for bare repositories, which have
+// no working tree to read from.
+func checkBlobContent(repo *git2go.Repository, path string, want []byte) error {
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("resolving HEAD: %w", err)
+	}
+	defer head.Free()
+
+	commit, err := repo.LookupCommit(head.Target())
+	if err != nil {
+		return fmt.Errorf("looking up HEAD commit: %w", err)
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("looking up HEAD tree: %w", err)
+	}
+	defer tree.Free()
+
+	entry, err := tree.EntryByPath(path)
+	if err != nil {
+		return fmt.Errorf("looking up %s: %w", path, err)
+	}
+	// The id of the blob is the hash of its content, which is compared
+	// first, as it does not need the blob to be read.
+	if entry.Id.String() == blobID(want) {
+		return nil
+	}
+	blob, err := repo.LookupBlob(entry.Id)
+	if err != nil {
+		return fmt.Errorf("looking up blob of %s: %w", path, err)
+	}
+	defer blob.Free()
+	return contentMismatch(path, blob.Contents(), want)
+}
+
+// checkObjects returns an error if any object in the object database
+// of repo does not hash to its id, or cannot be parsed.
+func checkObjects(repo *git2go.Repository) error {
+	odb, err := repo.Odb()
+	if err != nil {
+		return fmt.Errorf("opening object database: %w", err)
+	}
+	defer odb.Free()
+
+	var ids []*git2go.Oid
+	if err := odb.ForEach(func(id *git2go.Oid) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("listing objects: %w", err)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no objects in %s", repo.Path())
+	}
+
+	for _, id := range ids {
+		if err := checkObject(repo, odb, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkObject(repo *git2go.Repository, odb *git2go.Odb, id *git2go.Oid) error {
+	raw, err := odb.Read(id)
+	if err != nil {
+		return fmt.Errorf("reading object %s: %w", id, err)
+	}
+	defer raw.Free()
+
+	hash, err := odb.Hash(raw.Data(), raw.Type())
+	if err != nil {
+		return fmt.Errorf("hashing object %s: %w", id, err)
+	}
+	if !hash.Equal(id) {
+		return fmt.Errorf("object %s hashes to %s", id, hash)
+	}
+
+	obj, err := repo.Lookup(id)
+	if err != nil {
+		return fmt.Errorf("parsing object %s: %w", id, err)
+	}
+	obj.Free()
+	return nil
+}
+
+// objectIDs returns the sorted ids of the objects in the object
+// database of repo.
+func objectIDs(repo *git2go.Repository) ([]string, error) {
+	odb, err := repo.Odb()
+	if err != nil {
+		return nil, fmt.Errorf("opening object database: %w", err)
+	}
+	defer odb.Free()
+
+	var ids []string
+	if err := odb.ForEach(func(id *git2go.Oid) error {
+		ids = append(ids, id.String())
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("listing objects: %w", err)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// assertTreeHash returns an error if the root tree of branch in the
+// repository at repoPath, bare or not, is not wantTree. Equal root trees
+// mean the clone reproduced every file of the branch, as the tree id
+// covers the ids of all trees and blobs below it.
+func assertTreeHash(repoPath, branch string, wantTree *git2go.Oid) error {
+	got, err := branchTree(repoPath, branch)
+	if err != nil {
+		return err
+	}
+	if !got.Equal(wantTree) {
+		return fmt.Errorf("tree of %s in %s: got %s, want %s", branch, repoPath, got, wantTree)
+	}
+	return nil
+}
+
+// branchTree returns the id of the root tree of branch in the
+// repository at repoPath.
+func branchTree(repoPath, branch string) (*git2go.Oid, error) {
+	repo, err := git2go.OpenRepository(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", repoPath, err)
+	}
+	defer repo.Free()
+
+	ref, err := repo.References.Lookup("refs/heads/" + branch)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", branch, err)
+	}
+	defer ref.Free()
+	commit, err := repo.LookupCommit(ref.Target())
+	if err != nil {
+		return nil, fmt.Errorf("looking up commit of %s: %w", branch, err)
+	}
+	defer commit.Free()
+	return commit.TreeId(), nil
+}
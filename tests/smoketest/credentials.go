@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fluxcd/golang-with-libgit2/tests/sample/gitclone"
+	git2go "github.com/libgit2/git2go/v33"
+)
+
+// CredentialNegotiation is a call of a CredentialsCallback, with the
+// credential types libgit2 allowed, and the type of the credential
+// returned, 0 if none was.
+type CredentialNegotiation struct {
+	URL      string
+	Username string
+	Allowed  git2go.CredentialType
+	Returned git2go.CredentialType
+	Err      error
+}
+
+func (n CredentialNegotiation) String() string {
+	if n.Err != nil {
+		return fmt.Sprintf("credentials for %s: allowed %s, failed: %v", n.URL, n.Allowed, n.Err)
+	}
+	return fmt.Sprintf("credentials for %s: allowed %s, returned %s", n.URL, n.Allowed, n.Returned)
+}
+
+// loggingCredentialsCallback returns a CredentialsCallback calling
+// callback, which passes every call to logNegotiation, to debug the
+// authentication of clones, e.g. a server offering password
+// authentication only while an SSH key is expected. Passwords in the
+// URL are redacted. log.Print is a suitable logNegotiation.
+func loggingCredentialsCallback(callback git2go.CredentialsCallback, logNegotiation func(...interface{})) git2go.CredentialsCallback {
+	return func(url string, username string, allowedTypes git2go.CredentialType) (*git2go.Credential, error) {
+		cred, err := callback(url, username, allowedTypes)
+		n := CredentialNegotiation{
+			URL:      gitclone.URLPassword.ReplaceAllString(url, "${1}:xxxxx@"),
+			Username: username,
+			Allowed:  allowedTypes,
+			Err:      gitclone.RedactError(err),
+		}
+		if cred != nil {
+			n.Returned = cred.Type()
+		}
+		logNegotiation(n)
+		return cred, err
+	}
+}
+
+// userpassCredentialsCallback returns a CredentialsCallback that
+// authenticates with the given username and password.
+func userpassCredentialsCallback(username, password string) git2go.CredentialsCallback {
+	return gitclone.CredentialsCallback(&gitclone.UserpassProvider{Username: username, Password: password})
+}
+
+// cloneZeroingKey clones url into path like gitclone.CloneWith,
+// authenticating with the given PEM encoded private key, and zeroes
+// privateKey once the clone is done, successful or not. Only the
+// buffer of the caller is zeroed: the copies made of the key for each
+// authentication, see gitclone.SSHKeyProvider, are left to the garbage
+// collector and to libgit2, and stay in memory until reclaimed.
+func cloneZeroingKey(url, path string, options *git2go.CloneOptions, privateKey []byte) (*git2go.Repository, error) {
+	defer zero(privateKey)
+
+	opts := *options
+	opts.FetchOptions.RemoteCallbacks.CredentialsCallback = gitclone.CredentialsCallback(&gitclone.SSHKeyProvider{PrivateKey: privateKey})
+	return gitclone.CloneWith(url, path, &opts)
+}
+
+// zero overwrites b with zeros.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
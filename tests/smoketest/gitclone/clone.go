@@ -0,0 +1,405 @@
+// Package gitclone clones Git repositories with libgit2 through git2go,
+// verifying SSH host keys against known_hosts, authenticating with
+// CredentialProviders, and rejecting URLs outside of the supported
+// schemes or allowed hosts. Clone takes Options covering the common
+// cases, CloneRepo and CloneWith take git2go.CloneOptions for the
+// others.
+package gitclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	git2go "github.com/libgit2/git2go/v33"
+)
+
+// Options configure a clone by Clone, in place of git2go.CloneOptions
+// and callbacks assembled by hand.
+type Options struct {
+	// Bare clones without a working directory.
+	Bare bool
+	// Branch is the branch to check out, the default branch of the
+	// remote if empty.
+	Branch string
+	// Depth must be 0, libgit2 does not support shallow clones.
+	Depth int
+
+	// Username and Password authenticate to HTTP(S) servers. Password
+	// may be empty, for servers accepting a username only.
+	Username string
+	Password string
+	// PrivateKey is the PEM encoded private key authenticating to SSH
+	// servers.
+	PrivateKey []byte
+
+	// KnownHosts are the known_hosts entries the host keys of SSH
+	// servers are verified against.
+	KnownHosts []byte
+	// InsecureSkipHostKeyVerification accepts any SSH host key, see
+	// HostKeyOptions.
+	InsecureSkipHostKeyVerification bool
+	// HostKeyAlgorithms are the SSH host key algorithms accepted, like
+	// SSHOptions.HostKeyAlgorithms, e.g. ssh-ed25519 only to enforce
+	// modern host keys. The clone fails to negotiate with servers
+	// offering none of them. Any algorithm is accepted if empty.
+	HostKeyAlgorithms []string
+
+	// Timeout gives up on the clone once it has passed, on top of the
+	// deadline of the context of Clone. There is no timeout if zero.
+	Timeout time.Duration
+	// MaxObjectSize rejects clones with an object larger than that many
+	// bytes, there is no limit if zero.
+	MaxObjectSize uint64
+	// AllowedHosts restricts the hosts cloned from, like
+	// WithAllowedHosts. All hosts are allowed if empty.
+	AllowedHosts []string
+}
+
+// ErrShallowUnsupported is returned by Clone for options with a Depth.
+var ErrShallowUnsupported = errors.New("libgit2 does not support shallow clones")
+
+// Clone clones url into dir with opts, and returns the cloned
+// repository, which the caller must free with repo.Free. The URL is
+// checked like CloneRepo does. A clone given up on, because ctx is done
+// or opts.Timeout has passed, fails with the error of the context. A
+// clone rejected for opts.MaxObjectSize is removed.
+//
+// libgit2 cannot restrict host key algorithms, SSH clones with
+// opts.HostKeyAlgorithms go through the transport registered by
+// WithSSHOptions. The transport must stay registered until the clone
+// returns, so these clones are not given up on while they run in the
+// background, they return once aborted by their next transfer progress
+// callback.
+func Clone(ctx context.Context, url, dir string, opts Options) (*git2go.Repository, error) {
+	if opts.Depth != 0 {
+		return nil, fmt.Errorf("%w: depth %d", ErrShallowUnsupported, opts.Depth)
+	}
+	checks := []URLCheck{ValidateURL}
+	if len(opts.AllowedHosts) > 0 {
+		checks = append(checks, WithAllowedHosts(opts.AllowedHosts...))
+	}
+	for _, check := range checks {
+		if err := check(url); err != nil {
+			return nil, err
+		}
+	}
+
+	options, err := opts.CloneOptions(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	var repo *git2go.Repository
+	if isSSHURL(url) && len(opts.HostKeyAlgorithms) > 0 {
+		err = WithSSHOptions(SSHOptions{HostKeyAlgorithms: opts.HostKeyAlgorithms}, func() (err error) {
+			repo, err = CloneWith(url, dir, abortOnDone(ctx, options))
+			return err
+		})
+	} else {
+		repo, err = CloneContext(ctx, url, dir, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxObjectSize > 0 {
+		if err := CheckObjectSizes(repo, opts.MaxObjectSize); err != nil {
+			repo.Free()
+			if removeErr := os.RemoveAll(dir); removeErr != nil {
+				return nil, fmt.Errorf("%v, removing clone: %w", err, removeErr)
+			}
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// CloneOptions returns the git2go.CloneOptions Clone clones url with,
+// for callers adding callbacks of their own and cloning with CloneRepo.
+// They cover the checkout, credentials and host key verification of
+// opts, the other options are applied by Clone itself.
+func (opts Options) CloneOptions(url string) (*git2go.CloneOptions, error) {
+	options := &git2go.CloneOptions{Bare: opts.Bare, CheckoutBranch: opts.Branch}
+	if !opts.Bare {
+		// The zero git2go.CheckoutOptions do not check out any file.
+		options.CheckoutOptions.Strategy = git2go.CheckoutSafe
+	}
+	var providers []CredentialProvider
+	if opts.Username != "" {
+		providers = append(providers, &UserpassProvider{Username: opts.Username, Password: opts.Password})
+	}
+	if opts.PrivateKey != nil {
+		providers = append(providers, &SSHKeyProvider{PrivateKey: opts.PrivateKey})
+	}
+	if len(providers) > 0 {
+		options.FetchOptions.RemoteCallbacks.CredentialsCallback = CredentialsCallback(providers...)
+	}
+	if isSSHURL(url) {
+		host, port, err := URLHost(url)
+		if err != nil {
+			return nil, err
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		options.FetchOptions.RemoteCallbacks.CertificateCheckCallback = HostKeyCallback(HostKeyOptions{
+			Host:                            host,
+			KnownHosts:                      opts.KnownHosts,
+			InsecureSkipHostKeyVerification: opts.InsecureSkipHostKeyVerification,
+		})
+	}
+	return options, nil
+}
+
+// isSSHURL returns true for ssh:// and scp-like URLs.
+func isSSHURL(url string) bool {
+	return strings.HasPrefix(url, "ssh://") || SCPLikeURL.MatchString(url)
+}
+
+// CloneContext clones url into path like CloneWith, and gives up once ctx
+// is done, returning the error of ctx. libgit2 clones cannot be
+// cancelled, a clone given up on is aborted by the next transfer
+// progress callback. It runs in the background until then, and its
+// repository is freed if it completes.
+func CloneContext(ctx context.Context, url, path string, options *git2go.CloneOptions) (*git2go.Repository, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	opts := abortOnDone(ctx, options)
+
+	type result struct {
+		repo *git2go.Repository
+		err  error
+	}
+	cloned := make(chan result, 1)
+	go func() {
+		repo, err := CloneWith(url, path, opts)
+		cloned <- result{repo, err}
+	}()
+	select {
+	case r := <-cloned:
+		return r.repo, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-cloned; r.err == nil {
+				r.repo.Free()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// abortOnDone returns a copy of options, with a transfer progress
+// callback failing with the error of ctx once ctx is done.
+func abortOnDone(ctx context.Context, options *git2go.CloneOptions) *git2go.CloneOptions {
+	opts := git2go.CloneOptions{}
+	if options != nil {
+		opts = *options
+	}
+	transferProgress := opts.FetchOptions.RemoteCallbacks.TransferProgressCallback
+	opts.FetchOptions.RemoteCallbacks.TransferProgressCallback = func(stats git2go.TransferProgress) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if transferProgress != nil {
+			return transferProgress(stats)
+		}
+		return nil
+	}
+	return &opts
+}
+
+// CloneWithProgress clones url into path like CloneContext, and sends
+// every transfer progress of the clone to progress, which is closed
+// once CloneWithProgress returns. Sending blocks the thread of libgit2
+// running the clone until the progress is received, or ctx is done,
+// which aborts the clone. Callers not draining progress as the clone
+// goes must buffer it, or pass a ctx they cancel.
+func CloneWithProgress(ctx context.Context, url, path string, options *git2go.CloneOptions, progress chan<- git2go.TransferProgress) (*git2go.Repository, error) {
+	// The clone may still run in the background once ctx is done, the
+	// mutex keeps it from sending on the closed channel.
+	var mu sync.Mutex
+	closed := false
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		close(progress)
+	}()
+
+	opts := git2go.CloneOptions{}
+	if options != nil {
+		opts = *options
+	}
+	transferProgress := opts.FetchOptions.RemoteCallbacks.TransferProgressCallback
+	opts.FetchOptions.RemoteCallbacks.TransferProgressCallback = func(stats git2go.TransferProgress) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return ctx.Err()
+		}
+		select {
+		case progress <- stats:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if transferProgress != nil {
+			return transferProgress(stats)
+		}
+		return nil
+	}
+	return CloneContext(ctx, url, path, &opts)
+}
+
+// CloneFunc clones url into path. It is git2go.Clone, unless
+// substituted with WithCloneFunc. All clones made by CloneWith go
+// through it, so that callers can simulate failing, slow or stuck
+// clones without a server.
+var CloneFunc = git2go.Clone
+
+// WithCloneFunc runs fn with CloneFunc substituted by f, and restores
+// it once fn returns. Clones running in parallel with fn go through f
+// as well.
+func WithCloneFunc(f func(url, path string, options *git2go.CloneOptions) (*git2go.Repository, error), fn func() error) error {
+	saved := CloneFunc
+	CloneFunc = f
+	defer func() { CloneFunc = saved }()
+	return fn()
+}
+
+// CloneWith clones url into path with CloneFunc, redacting any credentials
+// from the returned error. Bare clones are checked with CheckBare.
+func CloneWith(url, path string, options *git2go.CloneOptions) (*git2go.Repository, error) {
+	if options != nil && options.FetchOptions.RemoteCallbacks.CredentialsCallback != nil {
+		opts := *options
+		opts.FetchOptions.RemoteCallbacks.CredentialsCallback = CheckedCredentialsCallback(options.FetchOptions.RemoteCallbacks.CredentialsCallback)
+		options = &opts
+	}
+	repo, err := CloneFunc(url, path, options)
+	if err != nil {
+		return nil, RedactError(err)
+	}
+	if options != nil && options.Bare {
+		if err := CheckBare(path); err != nil {
+			repo.Free()
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// CloneRepo clones url into path like CloneWith, after checking the URL
+// with ValidateURL, and returns the cloned repository for further
+// operations like fetches and walks. The caller must free it with
+// repo.Free.
+//
+// The URL must pass the given checks as well, e.g. WithAllowedHosts,
+// before anything is sent over the network.
+func CloneRepo(url, path string, options *git2go.CloneOptions, checks ...URLCheck) (*git2go.Repository, error) {
+	if err := ValidateURL(url); err != nil {
+		return nil, err
+	}
+	for _, check := range checks {
+		if err := check(url); err != nil {
+			return nil, err
+		}
+	}
+	return CloneWith(url, path, options)
+}
+
+// URLPassword matches the password in the user info of URLs.
+var URLPassword = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/:@\s]*):[^/@\s]*@`)
+
+// RedactError returns err with the password of any URL in its message
+// replaced by "xxxxx", as url.URL.Redacted does. The returned error
+// unwraps to err.
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := URLPassword.ReplaceAllString(err.Error(), "${1}:xxxxx@")
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg: msg, err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// CheckBare returns an error if the repository at repoPath is not bare,
+// or has a working tree checked out next to its git metadata.
+func CheckBare(repoPath string) error {
+	repo, err := git2go.OpenRepository(repoPath)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", repoPath, err)
+	}
+	defer repo.Free()
+
+	if !repo.IsBare() {
+		return fmt.Errorf("%s is not a bare repository", repoPath)
+	}
+	if workdir := repo.Workdir(); workdir != "" {
+		return fmt.Errorf("bare repository %s has a working tree at %s", repoPath, workdir)
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, "HEAD")); err != nil {
+		return fmt.Errorf("no git metadata in %s: %w", repoPath, err)
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, ".git")); err == nil {
+		return fmt.Errorf("bare repository %s has a .git directory", repoPath)
+	}
+	return nil
+}
+
+// ErrObjectTooLarge is returned by CheckObjectSizes for an object over
+// the size limit.
+var ErrObjectTooLarge = errors.New("object too large")
+
+// CheckObjectSizes returns an error wrapping ErrObjectTooLarge if any
+// object in the object database of repo is larger than limit bytes.
+func CheckObjectSizes(repo *git2go.Repository, limit uint64) error {
+	odb, err := repo.Odb()
+	if err != nil {
+		return fmt.Errorf("opening object database: %w", err)
+	}
+	defer odb.Free()
+
+	var tooLarge error
+	err = odb.ForEach(func(id *git2go.Oid) error {
+		size, objType, err := odb.ReadHeader(id)
+		if err != nil {
+			return fmt.Errorf("reading header of object %s: %w", id, err)
+		}
+		if size > limit {
+			tooLarge = fmt.Errorf("%w: %s %s is %d bytes, limit is %d", ErrObjectTooLarge, objType, id, size, limit)
+			return tooLarge
+		}
+		return nil
+	})
+	if tooLarge != nil {
+		return tooLarge
+	}
+	return err
+}
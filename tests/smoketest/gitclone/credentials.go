@@ -0,0 +1,153 @@
+package gitclone
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+
+	git2go "github.com/libgit2/git2go/v33"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// ErrUnsupportedAuthMethod is returned by credential callbacks when
+// none of the authentication methods offered by the server can be
+// satisfied.
+var ErrUnsupportedAuthMethod = errors.New("unsupported auth method")
+
+// CredentialProvider provides the credentials to authenticate to a Git
+// server with, e.g. refreshing tokens or looking them up in a vault.
+type CredentialProvider interface {
+	// Credentials returns a credential of one of the allowed types for
+	// url, or an error wrapping ErrUnsupportedAuthMethod if it does
+	// not provide any of them. username is the one in url, if any.
+	Credentials(url, username string, allowed git2go.CredentialType) (*git2go.Credential, error)
+}
+
+// ErrNoCredentialProvider is returned by HostCredentialProviders for
+// URLs of hosts without a provider.
+var ErrNoCredentialProvider = errors.New("no credential provider")
+
+// ErrNoCredential is returned for CredentialsCallbacks returning
+// neither a credential nor an error, which git2go passes on to libgit2
+// as success without a credential.
+var ErrNoCredential = errors.New("credential provider returned no credential")
+
+// MaxCredentialAttempts bounds how often a clone may ask for
+// credentials which keep being rejected. libgit2 gives up after 15
+// authentication replays, but the git2go managed HTTP transport asks
+// again after every 401 response, without a limit.
+const MaxCredentialAttempts = 16
+
+// ErrTooManyCredentialAttempts is returned by CredentialsCallbacks
+// asked for credentials more than MaxCredentialAttempts times.
+var ErrTooManyCredentialAttempts = errors.New("too many authentication attempts")
+
+// CheckedCredentialsCallback returns a CredentialsCallback calling
+// callback, which fails with ErrNoCredential if callback returns
+// neither a credential nor an error, and with
+// ErrTooManyCredentialAttempts once it has been called
+// MaxCredentialAttempts times. The callback is meant for a single
+// clone.
+func CheckedCredentialsCallback(callback git2go.CredentialsCallback) git2go.CredentialsCallback {
+	var attempts int32
+	return func(url string, username string, allowedTypes git2go.CredentialType) (*git2go.Credential, error) {
+		if atomic.AddInt32(&attempts, 1) > MaxCredentialAttempts {
+			return nil, fmt.Errorf("%w for %s", ErrTooManyCredentialAttempts, url)
+		}
+		cred, err := callback(url, username, allowedTypes)
+		if cred == nil && err == nil {
+			return nil, fmt.Errorf("%w for %s", ErrNoCredential, url)
+		}
+		return cred, err
+	}
+}
+
+// CredentialsCallback returns a CredentialsCallback that asks the given
+// providers for credentials in order, and returns the first credential
+// provided.
+func CredentialsCallback(providers ...CredentialProvider) git2go.CredentialsCallback {
+	return func(url string, username string, allowedTypes git2go.CredentialType) (*git2go.Credential, error) {
+		for _, p := range providers {
+			cred, err := p.Credentials(url, username, allowedTypes)
+			if errors.Is(err, ErrUnsupportedAuthMethod) || errors.Is(err, ErrNoCredentialProvider) {
+				continue
+			}
+			return cred, err
+		}
+		return nil, fmt.Errorf("%w: server allows %s", ErrUnsupportedAuthMethod, allowedTypes)
+	}
+}
+
+// HostCredentialProviders is a CredentialProvider asking the provider
+// of the host of the URL for credentials, for tools cloning from hosts
+// needing different credentials. Providers are looked up by host and
+// port first, then by host.
+type HostCredentialProviders map[string]CredentialProvider
+
+func (h HostCredentialProviders) Credentials(rawURL, username string, allowed git2go.CredentialType) (*git2go.Credential, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL: %w", err)
+	}
+	p, ok := h[u.Host]
+	if !ok {
+		p, ok = h[u.Hostname()]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w for host %s", ErrNoCredentialProvider, u.Host)
+	}
+	return p.Credentials(rawURL, username, allowed)
+}
+
+// UserpassProvider provides plain text username and password
+// credentials. The password may be empty, for servers accepting a
+// username only, e.g. anonymous access.
+type UserpassProvider struct {
+	Username string
+	Password string
+}
+
+func (p *UserpassProvider) Credentials(_, _ string, allowed git2go.CredentialType) (*git2go.Credential, error) {
+	if allowed&git2go.CredentialTypeUserpassPlaintext == 0 {
+		return nil, fmt.Errorf("%w: server allows %s", ErrUnsupportedAuthMethod, allowed)
+	}
+	return git2go.NewCredentialUserpassPlaintext(p.Username, p.Password)
+}
+
+// SSHKeyProvider provides SSH credentials for a PEM encoded private key
+// held in memory. Each authentication copies the key, into the parsed
+// key of a signer or into a string handed to libgit2. Zeroing
+// PrivateKey afterwards does not zero these copies.
+//
+// git2go does not expose a credential for keyboard-interactive
+// authentication, so servers offering only that method are refused
+// with ErrUnsupportedAuthMethod rather than left for libgit2 to fail
+// on.
+type SSHKeyProvider struct {
+	// Username defaults to the username in the URL, or git if there
+	// is none.
+	Username   string
+	PrivateKey []byte
+}
+
+func (p *SSHKeyProvider) Credentials(_, username string, allowed git2go.CredentialType) (*git2go.Credential, error) {
+	if allowed&(git2go.CredentialTypeSSHKey|git2go.CredentialTypeSSHCustom|git2go.CredentialTypeSSHMemory) == 0 {
+		return nil, fmt.Errorf("%w: server allows %s", ErrUnsupportedAuthMethod, allowed)
+	}
+	if p.Username != "" {
+		username = p.Username
+	} else if username == "" {
+		username = "git"
+	}
+	// The transport of WithSSHOptions only asks for keys in memory or
+	// in files, it cannot sign with a custom credential.
+	if allowed&git2go.CredentialTypeSSHCustom == 0 && allowed&git2go.CredentialTypeSSHMemory != 0 {
+		return git2go.NewCredentialSSHKeyFromMemory(username, "", string(p.PrivateKey), "")
+	}
+	signer, err := cryptossh.ParsePrivateKey(p.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return git2go.NewCredentialSSHKeyFromSigner(username, signer)
+}
@@ -0,0 +1,426 @@
+package gitclone
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	git2go "github.com/libgit2/git2go/v33"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHostsCallback returns a CertificateCheckCallback that verifies
+// the key of Git server against the given host and known_hosts for
+// git.SSH Transports.
+func KnownHostsCallback(host string, knownHosts []byte) git2go.CertificateCheckCallback {
+	host = canonicalHost(host)
+	return func(cert *git2go.Certificate, valid bool, hostname string) error {
+		hostname = canonicalHost(hostname)
+		if cert == nil {
+			return fmt.Errorf("no certificate returned for %s", hostname)
+		}
+		if err := checkCertValidity(host, cert.Hostkey, time.Now()); err != nil {
+			return err
+		}
+
+		kh, err := ParseKnownHosts(string(knownHosts))
+		if err != nil {
+			return err
+		}
+
+		// First, attempt to split the configured host and port to validate
+		// the port-less hostname given to the callback.
+		hostWithoutPort, _, err := net.SplitHostPort(host)
+		if err != nil {
+			// SplitHostPort returns an error if the host is missing
+			// a port, assume the host has no port.
+			hostWithoutPort = host
+		}
+
+		// Different versions of libgit handle this differently.
+		// This fixes the case in which ports may be sent back.
+		hostnameWithoutPort, _, err := net.SplitHostPort(hostname)
+		if err != nil {
+			hostnameWithoutPort = hostname
+		}
+
+		if hostnameWithoutPort != hostWithoutPort {
+			return fmt.Errorf("host mismatch: %q %q", hostnameWithoutPort, hostWithoutPort)
+		}
+
+		// We are now certain that the configured host and the hostname
+		// given to the callback match. Use the configured host (that
+		// includes the port), and normalize it, so we can check if there
+		// is an entry for the hostname _and_ port.
+		h := knownhosts.Normalize(host)
+		matching := MatchingKeys(kh, h, cert.Hostkey)
+		for _, k := range matching {
+			// A revoked key must be rejected, even if another entry
+			// lists it for the host.
+			if k.Revoked {
+				return fmt.Errorf("hostkey has been revoked")
+			}
+		}
+		if len(matching) > 0 {
+			return nil
+		}
+		hostKeyErr := &HostKeyError{
+			Host:    h,
+			Offered: fingerprintSHA256(cert.Hostkey.HashSHA256),
+		}
+		for _, k := range kh {
+			if ContainsHost(k.Hosts, h) && !k.Revoked {
+				hostKeyErr.Known = append(hostKeyErr.Known, cryptossh.FingerprintSHA256(k.Key))
+			}
+		}
+		return hostKeyErr
+	}
+}
+
+// HostKeyOptions configure the verification of SSH host keys by
+// HostKeyCallback.
+type HostKeyOptions struct {
+	// Host is the host to verify the key of, including the port if it
+	// is not the default one.
+	Host string
+	// KnownHosts are the known_hosts entries to verify the key against.
+	KnownHosts []byte
+	// InsecureSkipHostKeyVerification accepts any host key, which
+	// leaves connections open to man-in-the-middle attacks. It is only
+	// meant for ephemeral test environments, and must be set on
+	// purpose, an empty KnownHosts does not skip the verification.
+	InsecureSkipHostKeyVerification bool
+}
+
+// HostKeyCallback returns a CertificateCheckCallback verifying host
+// keys with KnownHostsCallback, unless the verification is skipped
+// with opts.InsecureSkipHostKeyVerification, which is logged.
+func HostKeyCallback(opts HostKeyOptions) git2go.CertificateCheckCallback {
+	if !opts.InsecureSkipHostKeyVerification {
+		return KnownHostsCallback(opts.Host, opts.KnownHosts)
+	}
+	log.Printf("WARNING: host key verification of %s is disabled, connections to it can be intercepted", opts.Host)
+	return func(*git2go.Certificate, bool, string) error {
+		return nil
+	}
+}
+
+// canonicalHost trims spaces around host, and the trailing dot of a
+// fully qualified host name, which known_hosts entries don't have. host
+// may include a port.
+func canonicalHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if h = strings.TrimSuffix(h, "."); h != "" {
+			return net.JoinHostPort(h, port)
+		}
+		return host
+	}
+	if h := strings.TrimSuffix(host, "."); h != "" {
+		return h
+	}
+	return host
+}
+
+// HostKeyError is returned by the callback of KnownHostsCallback when
+// the host key offered by the server does not match any known key of
+// the host.
+type HostKeyError struct {
+	// Host is the normalized host, including the port if it is not
+	// the default.
+	Host string
+	// Offered is the SHA256 fingerprint of the host key offered by
+	// the server.
+	Offered string
+	// Known are the SHA256 fingerprints of the known keys of Host.
+	Known []string
+}
+
+func (e *HostKeyError) Error() string {
+	known := "none"
+	if len(e.Known) > 0 {
+		known = strings.Join(e.Known, ", ")
+	}
+	return fmt.Sprintf("hostkey cannot be verified: %s offered %s, known: %s", e.Host, e.Offered, known)
+}
+
+// CertValidityError is returned by the callback of KnownHostsCallback
+// when the server offers a host certificate which is not valid at the
+// current time. This is often due to the clock of the client, or the
+// one of the CA which signed the certificate, being off.
+type CertValidityError struct {
+	// Host is the host the certificate was offered for.
+	Host string
+	// ValidAfter and ValidBefore are the validity window of the
+	// certificate. ValidBefore is zero for certificates which do not
+	// expire.
+	ValidAfter, ValidBefore time.Time
+	// Now is the time the certificate was checked at.
+	Now time.Time
+}
+
+func (e *CertValidityError) Error() string {
+	if e.Now.Before(e.ValidAfter) {
+		return fmt.Sprintf("host certificate of %s not yet valid: valid from %s, it is %s, check the clocks for skew",
+			e.Host, e.ValidAfter.UTC().Format(time.RFC3339), e.Now.UTC().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("host certificate of %s expired: valid until %s, it is %s, check the clocks for skew",
+		e.Host, e.ValidBefore.UTC().Format(time.RFC3339), e.Now.UTC().Format(time.RFC3339))
+}
+
+// checkCertValidity returns a *CertValidityError if hostkey is a host
+// certificate which is not valid at now. Plain host keys, and host keys
+// given as fingerprints only, have no validity.
+func checkCertValidity(host string, hostkey git2go.HostkeyCertificate, now time.Time) error {
+	if hostkey.Kind&git2go.HostkeyRaw == 0 {
+		return nil
+	}
+	cert, ok := hostkey.SSHPublicKey.(*cryptossh.Certificate)
+	if !ok {
+		return nil
+	}
+	unix := now.Unix()
+	expires := cert.ValidBefore != cryptossh.CertTimeInfinity
+	if unix >= 0 && uint64(unix) >= cert.ValidAfter && (!expires || uint64(unix) < cert.ValidBefore) {
+		return nil
+	}
+	err := &CertValidityError{
+		Host:       host,
+		ValidAfter: time.Unix(int64(cert.ValidAfter), 0),
+		Now:        now,
+	}
+	if expires {
+		err.ValidBefore = time.Unix(int64(cert.ValidBefore), 0)
+	}
+	return err
+}
+
+// fingerprintSHA256 formats hash like ssh.FingerprintSHA256.
+func fingerprintSHA256(hash [32]byte) string {
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+// KnownKey is a key of a known_hosts entry, as parsed by
+// ParseKnownHosts.
+type KnownKey struct {
+	Hosts   []string
+	Key     cryptossh.PublicKey
+	Revoked bool
+	// CertAuthority is set for @cert-authority entries, for which Key
+	// is the key of a CA trusted to sign host certificates.
+	CertAuthority bool
+	// Line is the line of the key in known_hosts, starting at 1.
+	Line int
+}
+
+// ErrRFC4716Key is returned by ParseKnownHosts for keys in the RFC4716
+// format, which some tools export keys in, rather than known_hosts
+// lines.
+var ErrRFC4716Key = errors.New("RFC4716 public key instead of known_hosts entries, convert it with KnownHostsFromRFC4716 or ssh-keygen -i")
+
+// ParseKnownHosts parses the known_hosts entries in s, skipping blank
+// lines and comments.
+func ParseKnownHosts(s string) ([]KnownKey, error) {
+	var knownHosts []KnownKey
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	var line int
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == rfc4716Begin {
+			return nil, fmt.Errorf("line %d: %w", line, ErrRFC4716Key)
+		}
+		marker, hosts, pubKey, _, _, err := cryptossh.ParseKnownHosts(scanner.Bytes())
+		if err != nil {
+			// Lines that aren't host public key result in EOF, like a comment
+			// line. Continue parsing the other lines.
+			if err == io.EOF {
+				continue
+			}
+			return []KnownKey{}, err
+		}
+
+		knownHost := KnownKey{
+			Hosts:         hosts,
+			Key:           pubKey,
+			Revoked:       marker == "revoked",
+			CertAuthority: marker == "cert-authority",
+			Line:          line,
+		}
+		knownHosts = append(knownHosts, knownHost)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return []KnownKey{}, err
+	}
+
+	return knownHosts, nil
+}
+
+const (
+	rfc4716Begin = "---- BEGIN SSH2 PUBLIC KEY ----"
+	rfc4716End   = "---- END SSH2 PUBLIC KEY ----"
+)
+
+// KnownHostsFromRFC4716 returns known_hosts entries listing the public
+// keys in data, in the RFC4716 format, for hosts. Headers like
+// Comment are ignored.
+func KnownHostsFromRFC4716(hosts []string, data []byte) ([]byte, error) {
+	var knownHosts []byte
+	var body strings.Builder
+	inKey, continued := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case !inKey && line == rfc4716Begin:
+			inKey = true
+			body.Reset()
+		case !inKey && line != "":
+			return nil, fmt.Errorf("unexpected %q outside of an RFC4716 key", line)
+		case !inKey:
+		case line == rfc4716End:
+			blob, err := base64.StdEncoding.DecodeString(body.String())
+			if err != nil {
+				return nil, fmt.Errorf("decoding RFC4716 key: %w", err)
+			}
+			key, err := cryptossh.ParsePublicKey(blob)
+			if err != nil {
+				return nil, fmt.Errorf("parsing RFC4716 key: %w", err)
+			}
+			knownHosts = append(knownHosts, knownhosts.Line(hosts, key)+"\n"...)
+			inKey = false
+		case continued || strings.Contains(line, ":"):
+			// Headers continue on the next line if they end with a
+			// backslash.
+			continued = strings.HasSuffix(line, "\\")
+		default:
+			body.WriteString(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if inKey {
+		return nil, fmt.Errorf("RFC4716 key without %q", rfc4716End)
+	}
+	if len(knownHosts) == 0 {
+		return nil, errors.New("no RFC4716 key found")
+	}
+	return knownHosts, nil
+}
+
+// MatchingKeys returns the keys of kh listed for host which match
+// hostkey, in known_hosts order.
+func MatchingKeys(kh []KnownKey, host string, hostkey git2go.HostkeyCertificate) []KnownKey {
+	var matching []KnownKey
+	for _, k := range kh {
+		if k.Matches(host, hostkey) {
+			matching = append(matching, k)
+		}
+	}
+	return matching
+}
+
+// Matches returns true if k is a key of host, and hostkey is k, or a
+// host certificate signed by k for @cert-authority entries.
+func (k KnownKey) Matches(host string, hostkey git2go.HostkeyCertificate) bool {
+	if !ContainsHost(k.Hosts, host) {
+		return false
+	}
+	if k.CertAuthority {
+		return k.signed(host, hostkey)
+	}
+	marshaled := k.Key.Marshal()
+	// With the raw key, there is no need for fingerprints. A
+	// certificate claiming the raw key without one is malformed.
+	if hostkey.Kind&git2go.HostkeyRaw != 0 {
+		return hostkey.SSHPublicKey != nil && bytes.Equal(marshaled, hostkey.Hostkey)
+	}
+
+	// Kind is a bitmask, libgit2 may provide several fingerprints of
+	// the key. Try the strongest first, and only fail if none match.
+	for _, f := range []struct {
+		kind        git2go.HostkeyKind
+		newHash     func() hash.Hash
+		fingerprint []byte
+	}{
+		{git2go.HostkeySHA256, sha256.New, hostkey.HashSHA256[:]},
+		{git2go.HostkeySHA1, sha1.New, hostkey.HashSHA1[:]},
+		{git2go.HostkeyMD5, md5.New, hostkey.HashMD5[:]},
+	} {
+		// A fingerprint left zeroed by a malformed certificate is never
+		// compared, whatever the key.
+		if hostkey.Kind&f.kind == 0 || bytes.Equal(f.fingerprint, make([]byte, len(f.fingerprint))) {
+			continue
+		}
+		hasher := f.newHash()
+		hasher.Write(marshaled)
+		if bytes.Equal(hasher.Sum(nil), f.fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// signed returns true if hostkey is a host certificate for host signed
+// by the CA of k. This needs the raw key, the fingerprints of the
+// certificate can't be matched against the key of the CA.
+func (k KnownKey) signed(host string, hostkey git2go.HostkeyCertificate) bool {
+	if hostkey.Kind&git2go.HostkeyRaw == 0 {
+		return false
+	}
+	cert, ok := hostkey.SSHPublicKey.(*cryptossh.Certificate)
+	if !ok || cert.CertType != cryptossh.HostCert {
+		return false
+	}
+	if !bytes.Equal(cert.SignatureKey.Marshal(), k.Key.Marshal()) {
+		return false
+	}
+	// Principals are host names without the port.
+	principal, _, err := net.SplitHostPort(host)
+	if err != nil {
+		principal = host
+	}
+	principal = strings.Trim(principal, "[]")
+	checker := &cryptossh.CertChecker{}
+	return checker.CheckCert(principal, cert) == nil
+}
+
+// ContainsHost returns true if host is one of hosts.
+func ContainsHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// HostkeyCertificate returns the Certificate libgit2 would pass to the
+// CertificateCheckCallback for a server with the given host key.
+func HostkeyCertificate(key cryptossh.PublicKey) *git2go.Certificate {
+	raw := key.Marshal()
+	return &git2go.Certificate{
+		Kind: git2go.CertificateHostkey,
+		Hostkey: git2go.HostkeyCertificate{
+			Kind:         git2go.HostkeyMD5 | git2go.HostkeySHA1 | git2go.HostkeySHA256 | git2go.HostkeyRaw,
+			HashMD5:      md5.Sum(raw),
+			HashSHA1:     sha1.Sum(raw),
+			HashSHA256:   sha256.Sum256(raw),
+			Hostkey:      raw,
+			SSHPublicKey: key,
+		},
+	}
+}
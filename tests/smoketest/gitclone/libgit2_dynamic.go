@@ -0,0 +1,11 @@
+//go:build !static_build
+// +build !static_build
+
+package gitclone
+
+// Other builds link libgit2 dynamically.
+
+/*
+#cgo pkg-config: libgit2
+*/
+import "C"
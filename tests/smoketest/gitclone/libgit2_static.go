@@ -0,0 +1,12 @@
+//go:build static_build
+// +build static_build
+
+package gitclone
+
+// Static builds, made with the static_build tag by the Makefile and
+// Dockerfile.test, link libgit2 and its dependencies statically.
+
+/*
+#cgo pkg-config: --static libgit2
+*/
+import "C"
@@ -0,0 +1,175 @@
+package gitclone
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// SSHAlgorithms are the algorithms negotiated for an SSH connection.
+type SSHAlgorithms struct {
+	KeyExchange string
+	HostKey     string
+}
+
+// ErrWeakSSHAlgorithm is returned for connections negotiating an
+// algorithm disallowed by a policy.
+var ErrWeakSSHAlgorithm = errors.New("SSH algorithm disallowed by policy")
+
+// sha1SSHAlgorithms are the key exchange and host key algorithms using
+// SHA-1.
+var sha1SSHAlgorithms = map[string]bool{
+	"diffie-hellman-group1-sha1":         true,
+	"diffie-hellman-group14-sha1":        true,
+	"diffie-hellman-group-exchange-sha1": true,
+	"ssh-rsa":                            true,
+	"ssh-dss":                            true,
+	"ssh-rsa-cert-v01@openssh.com":       true,
+	"ssh-dss-cert-v01@openssh.com":       true,
+}
+
+// RejectSHA1 is a policy for SSHOptions.Algorithms, failing connections
+// negotiating algorithms using SHA-1.
+func RejectSHA1(a SSHAlgorithms) error {
+	for _, alg := range []string{a.KeyExchange, a.HostKey} {
+		if sha1SSHAlgorithms[alg] {
+			return fmt.Errorf("%w: %s uses SHA-1", ErrWeakSSHAlgorithm, alg)
+		}
+	}
+	return nil
+}
+
+// kexObservingConn is a net.Conn recording the algorithms offered in
+// the first SSH_MSG_KEXINIT message of each side of an SSH connection,
+// to tell which algorithms were negotiated. golang.org/x/crypto/ssh does
+// not expose them.
+type kexObservingConn struct {
+	net.Conn
+
+	mu             sync.Mutex
+	client, server kexInitParser
+}
+
+func (c *kexObservingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.server.feed(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *kexObservingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.client.feed(p)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+// negotiated returns the algorithms negotiated, which are the first of
+// the client offered by the server, as in RFC 4253 section 7.1.
+func (c *kexObservingConn) negotiated() (SSHAlgorithms, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.client.done || !c.server.done {
+		return SSHAlgorithms{}, errors.New("key exchange not observed")
+	}
+	var a SSHAlgorithms
+	var err error
+	if a.KeyExchange, err = firstCommon("key exchange", c.client.kex, c.server.kex); err != nil {
+		return a, err
+	}
+	a.HostKey, err = firstCommon("host key", c.client.hostKey, c.server.hostKey)
+	return a, err
+}
+
+func firstCommon(what string, client, server []string) (string, error) {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no common %s algorithm", what)
+}
+
+// msgKexInit is SSH_MSG_KEXINIT.
+const msgKexInit = 20
+
+// maxPacketLength is the largest packet length implementations must
+// support, as in RFC 4253 section 6.1. The packet length is sent by
+// the other side, longer ones are not buffered.
+const maxPacketLength = 35000
+
+// kexInitParser parses the algorithm lists of the first
+// SSH_MSG_KEXINIT message of one side of an SSH connection, which is
+// sent in the clear after the identification string.
+type kexInitParser struct {
+	buf        []byte
+	identified bool
+	// done is set once the message is parsed, or could not be.
+	done         bool
+	kex, hostKey []string
+}
+
+func (p *kexInitParser) feed(b []byte) {
+	if p.done {
+		return
+	}
+	p.buf = append(p.buf, b...)
+	// Servers may send other lines before the identification string.
+	for !p.identified {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return
+		}
+		p.identified = bytes.HasPrefix(p.buf[:i], []byte("SSH-"))
+		p.buf = p.buf[i+1:]
+	}
+	if len(p.buf) < 5 {
+		return
+	}
+	length := binary.BigEndian.Uint32(p.buf)
+	if length == 0 || length > maxPacketLength {
+		p.done = true
+		p.buf = nil
+		return
+	}
+	if uint64(len(p.buf)) < 4+uint64(length) {
+		return
+	}
+	p.done = true
+	packet := p.buf[4 : 4+length]
+	p.buf = nil
+	padding := int(packet[0])
+	if padding+1 > len(packet) {
+		return
+	}
+	payload := packet[1 : len(packet)-padding]
+	// The message type is followed by a 16 byte cookie.
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return
+	}
+	rest := payload[17:]
+	p.kex, rest = parseNameList(rest)
+	p.hostKey, _ = parseNameList(rest)
+}
+
+func parseNameList(b []byte) ([]string, []byte) {
+	if len(b) < 4 {
+		return nil, nil
+	}
+	length := binary.BigEndian.Uint32(b)
+	if uint64(len(b)) < 4+uint64(length) {
+		return nil, nil
+	}
+	list := string(b[4 : 4+length])
+	if list == "" {
+		return nil, b[4:]
+	}
+	return strings.Split(list, ","), b[4+length:]
+}
@@ -0,0 +1,430 @@
+package gitclone
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	git2go "github.com/libgit2/git2go/v33"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// managedTransports keeps the git2go managed transports registered
+// again by WithSmartTransport from being freed by the garbage collector.
+var managedTransports = map[string]*git2go.RegisteredSmartTransport{}
+
+// ErrRegisterTransport is returned by WithSmartTransport if the
+// transport cannot be registered.
+var ErrRegisterTransport = errors.New("cannot register transport for")
+
+// WithSmartTransport runs fn with a smart transport registered for
+// protocol. Once fn returns, the transport is unregistered, and clones
+// go through the transport of libgit2 again, or the git2go managed
+// transport if libgit2 was built without support for protocol.
+func WithSmartTransport(protocol string, stateless bool, callback git2go.SmartSubtransportCallback, fn func() error) error {
+	// Transports are registered process wide, like the global settings.
+	return WithGlobalSettings(func() (err error) {
+		if managed, ok := managedTransports[protocol]; ok {
+			if err := managed.Free(); err != nil {
+				return fmt.Errorf("unregistering managed %s transport: %w", protocol, err)
+			}
+			delete(managedTransports, protocol)
+		}
+		registered, err := git2go.NewRegisteredSmartTransport(protocol, stateless, callback)
+		if err != nil {
+			return fmt.Errorf("%w %s: %v", ErrRegisterTransport, protocol, err)
+		}
+		defer func() {
+			if freeErr := registered.Free(); freeErr != nil && err == nil {
+				err = fmt.Errorf("unregistering %s transport: %w", protocol, freeErr)
+				return
+			}
+			// Registering a transport replaces the git2go managed one
+			// for good, so it needs to be registered again.
+			if managedErr := restoreManagedTransport(protocol); managedErr != nil && err == nil {
+				err = fmt.Errorf("registering managed %s transport: %w", protocol, managedErr)
+			}
+		}()
+		return fn()
+	})
+}
+
+func restoreManagedTransport(protocol string) error {
+	var managed *git2go.RegisteredSmartTransport
+	var err error
+	switch {
+	case (protocol == "http" || protocol == "https") && !Libgit2HTTP():
+		managed, err = git2go.RegisterManagedHTTPTransport(protocol)
+	case protocol == "ssh" && !Libgit2SSH():
+		managed, err = git2go.RegisterManagedSSHTransport(protocol)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	managedTransports[protocol] = managed
+	return nil
+}
+
+// SSHOptions are options for SSH clones like the ones of ssh_config.
+// libgit2 does not expose any of them, its libssh2 transport and the
+// git2go managed SSH transport negotiate algorithms and authentication
+// methods on their own. They are applied by the transport registered
+// by WithSSHOptions instead.
+type SSHOptions struct {
+	// HostKeyAlgorithms are the host key algorithms accepted from the
+	// server, in order of preference, like HostKeyAlgorithms in
+	// ssh_config. The defaults of golang.org/x/crypto/ssh are used if
+	// empty.
+	HostKeyAlgorithms []string
+	// PreferredAuthentications are the authentication methods to try,
+	// in order, like PreferredAuthentications in ssh_config. Only
+	// "publickey" and "password" are supported. Defaults to
+	// "publickey".
+	PreferredAuthentications []string
+	// Dial connects to the SSH server, net.Dial is used if nil. To go
+	// through a jump host like ProxyJump in ssh_config, set it to the
+	// Dial method of an ssh.Client connected to the jump host.
+	Dial func(network, addr string) (net.Conn, error)
+	// Algorithms, if not nil, is called with the algorithms negotiated
+	// with the server before its host key is verified, e.g. to record
+	// them for auditing, or to enforce a policy like RejectSHA1. An
+	// error fails the connection.
+	Algorithms func(SSHAlgorithms) error
+}
+
+// WithSSHOptions runs fn with SSH clones going through a transport
+// applying options. The transport asks the CredentialsCallback of the
+// clone for CredentialTypeSSHMemory or CredentialTypeSSHKey credentials
+// for publickey, and CredentialTypeUserpassPlaintext for password
+// authentication, keys from CredentialTypeSSHCustom are not supported.
+func WithSSHOptions(options SSHOptions, fn func() error) error {
+	return WithSmartTransport("ssh", false, func(_ *git2go.Remote, transport *git2go.Transport) (git2go.SmartSubtransport, error) {
+		return &sshOptionsSubtransport{transport: transport, options: options}, nil
+	}, fn)
+}
+
+// sshOptionsSubtransport is a git2go.SmartSubtransport running the git
+// commands over a golang.org/x/crypto/ssh client configured with
+// SSHOptions.
+type sshOptionsSubtransport struct {
+	transport *git2go.Transport
+	options   SSHOptions
+
+	lastAction git2go.SmartServiceAction
+	conn       *kexObservingConn
+	client     *cryptossh.Client
+	session    *cryptossh.Session
+	stream     *sshOptionsStream
+}
+
+func (t *sshOptionsSubtransport) Action(rawURL string, action git2go.SmartServiceAction) (git2go.SmartSubtransportStream, error) {
+	var command string
+	switch action {
+	case git2go.SmartServiceActionUploadpackLs, git2go.SmartServiceActionUploadpack:
+		command = "git-upload-pack"
+	case git2go.SmartServiceActionReceivepackLs, git2go.SmartServiceActionReceivepack:
+		command = "git-receive-pack"
+	default:
+		return nil, fmt.Errorf("unknown action %d", action)
+	}
+	// The command started for listing the refs goes on to send or
+	// receive the pack.
+	if t.stream != nil {
+		if (t.lastAction == git2go.SmartServiceActionUploadpackLs && action == git2go.SmartServiceActionUploadpack) ||
+			(t.lastAction == git2go.SmartServiceActionReceivepackLs && action == git2go.SmartServiceActionReceivepack) {
+			t.lastAction = action
+			return t.stream, nil
+		}
+		t.Close()
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	user := "git"
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+
+	auth, err := t.authMethods(user)
+	if err != nil {
+		return nil, err
+	}
+	config := &cryptossh.ClientConfig{
+		User:              user,
+		Auth:              auth,
+		HostKeyAlgorithms: t.options.HostKeyAlgorithms,
+		HostKeyCallback: func(_ string, _ net.Addr, key cryptossh.PublicKey) error {
+			if t.options.Algorithms != nil {
+				algorithms, err := t.conn.negotiated()
+				if err != nil {
+					return err
+				}
+				if err := t.options.Algorithms(algorithms); err != nil {
+					return err
+				}
+			}
+			return t.transport.SmartCertificateCheck(HostkeyCertificate(key), true, u.Hostname())
+		},
+	}
+	if t.client, err = t.dial(net.JoinHostPort(u.Hostname(), port), config); err != nil {
+		return nil, err
+	}
+	if t.session, err = t.client.NewSession(); err != nil {
+		return nil, err
+	}
+	stream := &sshOptionsStream{}
+	if stream.stdin, err = t.session.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if stream.stdout, err = t.session.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	path := strings.ReplaceAll(u.Path, "'", `'\''`)
+	if err := t.session.Start(fmt.Sprintf("%s '%s'", command, path)); err != nil {
+		return nil, err
+	}
+
+	t.lastAction = action
+	t.stream = stream
+	return stream, nil
+}
+
+func (t *sshOptionsSubtransport) dial(addr string, config *cryptossh.ClientConfig) (*cryptossh.Client, error) {
+	dial := t.options.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = &kexObservingConn{Conn: conn}
+	c, chans, reqs, err := cryptossh.NewClientConn(t.conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cryptossh.NewClient(c, chans, reqs), nil
+}
+
+func (t *sshOptionsSubtransport) authMethods(user string) ([]cryptossh.AuthMethod, error) {
+	preferred := t.options.PreferredAuthentications
+	if len(preferred) == 0 {
+		preferred = []string{"publickey"}
+	}
+	var methods []cryptossh.AuthMethod
+	for _, method := range preferred {
+		switch method {
+		case "publickey":
+			methods = append(methods, cryptossh.PublicKeysCallback(func() ([]cryptossh.Signer, error) {
+				return t.signers(user)
+			}))
+		case "password":
+			methods = append(methods, cryptossh.PasswordCallback(func() (string, error) {
+				return t.password(user)
+			}))
+		default:
+			return nil, fmt.Errorf("unsupported authentication method %q", method)
+		}
+	}
+	return methods, nil
+}
+
+func (t *sshOptionsSubtransport) signers(user string) ([]cryptossh.Signer, error) {
+	cred, err := t.transport.SmartCredentials(user, git2go.CredentialTypeSSHMemory|git2go.CredentialTypeSSHKey)
+	if err != nil {
+		return nil, err
+	}
+	defer cred.Free()
+
+	_, _, privateKey, passphrase, err := cred.GetSSHKey()
+	if err != nil {
+		return nil, err
+	}
+	pemBytes := []byte(privateKey)
+	if cred.Type() == git2go.CredentialTypeSSHKey {
+		if pemBytes, err = os.ReadFile(privateKey); err != nil {
+			return nil, err
+		}
+	}
+
+	var signer cryptossh.Signer
+	if passphrase != "" {
+		signer, err = cryptossh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		signer, err = cryptossh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []cryptossh.Signer{signer}, nil
+}
+
+func (t *sshOptionsSubtransport) password(user string) (string, error) {
+	cred, err := t.transport.SmartCredentials(user, git2go.CredentialTypeUserpassPlaintext)
+	if err != nil {
+		return "", err
+	}
+	defer cred.Free()
+	_, password, err := cred.GetUserpassPlaintext()
+	return password, err
+}
+
+func (t *sshOptionsSubtransport) Close() error {
+	t.stream = nil
+	if t.client == nil {
+		return nil
+	}
+	if t.session != nil {
+		t.session.Close()
+		t.session = nil
+	}
+	err := t.client.Close()
+	t.client = nil
+	return err
+}
+
+func (t *sshOptionsSubtransport) Free() {
+	t.Close()
+}
+
+type sshOptionsStream struct {
+	stdin  io.WriteCloser
+	stdout io.Reader
+}
+
+func (s *sshOptionsStream) Read(p []byte) (int, error) {
+	return s.stdout.Read(p)
+}
+
+func (s *sshOptionsStream) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+func (s *sshOptionsStream) Free() {
+}
+
+// globalSettingsMu guards the libgit2 global settings, which are
+// shared by every clone in the process.
+var globalSettingsMu sync.Mutex
+
+// globalSettings is a snapshot of the libgit2 global settings which
+// callers of WithGlobalSettings may change.
+type globalSettings struct {
+	searchPaths        map[git2go.ConfigLevel]string
+	mwindowSize        int
+	mwindowMappedLimit int
+	userAgent          string
+}
+
+// ConfigLevels are the config levels with a search path that can be
+// read and set on all platforms.
+var ConfigLevels = []git2go.ConfigLevel{
+	git2go.ConfigLevelSystem,
+	git2go.ConfigLevelXDG,
+	git2go.ConfigLevelGlobal,
+}
+
+// WithGlobalSettings runs fn with exclusive access to the libgit2
+// global settings, and restores the settings to their previous values
+// once fn returns. Callers changing global settings must do so through
+// this, to not interfere with clones running in parallel.
+func WithGlobalSettings(fn func() error) (err error) {
+	globalSettingsMu.Lock()
+	defer globalSettingsMu.Unlock()
+
+	saved, err := loadGlobalSettings()
+	if err != nil {
+		return fmt.Errorf("saving global settings: %w", err)
+	}
+	defer func() {
+		if restoreErr := saved.apply(); restoreErr != nil && err == nil {
+			err = fmt.Errorf("restoring global settings: %w", restoreErr)
+		}
+	}()
+	return fn()
+}
+
+func loadGlobalSettings() (*globalSettings, error) {
+	s := &globalSettings{searchPaths: map[git2go.ConfigLevel]string{}}
+	for _, level := range ConfigLevels {
+		path, err := git2go.SearchPath(level)
+		if err != nil {
+			return nil, err
+		}
+		s.searchPaths[level] = path
+	}
+
+	var err error
+	if s.mwindowSize, err = git2go.MwindowSize(); err != nil {
+		return nil, err
+	}
+	if s.mwindowMappedLimit, err = git2go.MwindowMappedLimit(); err != nil {
+		return nil, err
+	}
+	if s.userAgent, err = userAgent(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *globalSettings) apply() error {
+	for level, path := range s.searchPaths {
+		if err := git2go.SetSearchPath(level, path); err != nil {
+			return err
+		}
+	}
+	if err := git2go.SetMwindowSize(s.mwindowSize); err != nil {
+		return err
+	}
+	if err := git2go.SetMwindowMappedLimit(s.mwindowMappedLimit); err != nil {
+		return err
+	}
+	return setUserAgent(s.userAgent)
+}
+
+// UserAgent returns the user agent libgit2 sends over HTTP(S), or an
+// empty string if it uses its default.
+func UserAgent() (string, error) {
+	return userAgent()
+}
+
+// WithUserAgent runs fn with libgit2 sending "git/2.0 (userAgent)" as
+// its user agent over HTTP(S), and restores the previous one once fn
+// returns. The git2go managed HTTP transport always sends its own.
+func WithUserAgent(userAgent string, fn func() error) error {
+	return WithGlobalSettings(func() error {
+		if err := setUserAgent(userAgent); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// Libgit2HTTP returns true if HTTP(S) is served by libgit2 itself. When
+// libgit2 is built without HTTPS support, git2go registers its managed
+// transport for both HTTP and HTTPS instead, which surfaces Go errors
+// and does not invoke certificate callbacks.
+func Libgit2HTTP() bool {
+	return git2go.Features()&git2go.FeatureHTTPS != 0
+}
+
+// Libgit2SSH returns true if SSH is served by libgit2 through libssh2.
+// Otherwise git2go registers its managed transport, which always asks
+// for key credentials regardless of the methods the server offers.
+func Libgit2SSH() bool {
+	return git2go.Features()&git2go.FeatureSSH != 0
+}
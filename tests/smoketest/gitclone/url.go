@@ -0,0 +1,95 @@
+package gitclone
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// SupportedSchemes are the URL schemes clones are accepted for. This is
+// a subset of the transports of libgit2, git:// and local paths are
+// left out, git:// being neither authenticated nor encrypted.
+var SupportedSchemes = []string{"http", "https", "ssh"}
+
+// SCPLikeURL matches the scp-like syntax for SSH URLs, e.g.
+// git@example.com:org/repo.git.
+var SCPLikeURL = regexp.MustCompile(`^[^/@:]+@[^/:]+:[^/]`)
+
+// URLCheck checks a URL given to CloneRepo before it is cloned.
+type URLCheck func(rawURL string) error
+
+// ErrHostNotAllowed is returned by the URLCheck of WithAllowedHosts for
+// URLs of hosts which are not allowed.
+var ErrHostNotAllowed = errors.New("host not allowed")
+
+// WithAllowedHosts returns a URLCheck rejecting URLs of other hosts
+// than the given ones, e.g. for services cloning URLs given by users.
+// A host without a port allows any port, one with a port only that
+// port. Host names are matched case-insensitively, and are not
+// resolved.
+func WithAllowedHosts(hosts ...string) URLCheck {
+	return func(rawURL string) error {
+		host, port, err := URLHost(rawURL)
+		if err != nil {
+			return err
+		}
+		for _, allowed := range hosts {
+			if strings.EqualFold(allowed, host) || strings.EqualFold(allowed, net.JoinHostPort(host, port)) {
+				return nil
+			}
+		}
+		// The URL is left out, it may contain credentials.
+		return fmt.Errorf("%w: %s is not one of %s", ErrHostNotAllowed, host, strings.Join(hosts, ", "))
+	}
+}
+
+// URLHost returns the host and port of a URL passing ValidateURL.
+// The port is empty if the URL has none.
+func URLHost(rawURL string) (host, port string, err error) {
+	if SCPLikeURL.MatchString(rawURL) {
+		host = rawURL[strings.Index(rawURL, "@")+1:]
+		return host[:strings.Index(host, ":")], "", nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrUnsupportedURL, errors.Unwrap(err))
+	}
+	return u.Hostname(), u.Port(), nil
+}
+
+// ErrUnsupportedURL is returned by ValidateURL for URLs that do not
+// use one of the SupportedSchemes.
+var ErrUnsupportedURL = errors.New("unsupported clone URL")
+
+// ValidateURL returns an error listing the supported schemes if
+// the given URL does not use one of them, or the scp-like SSH syntax.
+// It rejects git:// and local paths, even though libgit2 can clone
+// them. Checking this up front also gives a clearer error than the one
+// libgit2 returns when it cannot find a transport for the URL.
+//
+// The URL itself is left out of the error, as it may contain
+// credentials.
+func ValidateURL(rawURL string) error {
+	if SCPLikeURL.MatchString(rawURL) {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Unwrap to leave the URL out of the error.
+		return fmt.Errorf("%w: %v", ErrUnsupportedURL, errors.Unwrap(err))
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("%w: missing scheme, supported schemes are: %s",
+			ErrUnsupportedURL, strings.Join(SupportedSchemes, ", "))
+	}
+	for _, scheme := range SupportedSchemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: scheme %q is not supported, supported schemes are: %s",
+		ErrUnsupportedURL, u.Scheme, strings.Join(SupportedSchemes, ", "))
+}
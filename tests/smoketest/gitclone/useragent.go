@@ -0,0 +1,56 @@
+package gitclone
+
+/*
+#include <stdlib.h>
+#include <git2.h>
+
+// git_libgit2_opts is variadic, which cgo cannot call.
+static int get_user_agent(git_buf *out) {
+	return git_libgit2_opts(GIT_OPT_GET_USER_AGENT, out);
+}
+
+static int set_user_agent(const char *user_agent) {
+	return git_libgit2_opts(GIT_OPT_SET_USER_AGENT, user_agent);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// userAgent returns the user agent set with setUserAgent, or an empty
+// string if libgit2 uses its default.
+func userAgent() (string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var buf C.git_buf
+	defer C.git_buf_dispose(&buf)
+	if rc := C.get_user_agent(&buf); rc < 0 {
+		return "", fmt.Errorf("getting user agent: libgit2 error %d", rc)
+	}
+	return C.GoStringN(buf.ptr, C.int(buf.size)), nil
+}
+
+// setUserAgent sets the user agent libgit2 sends over HTTP(S) to
+// "git/2.0 (userAgent)", or back to its default if userAgent is empty.
+// The git2go managed HTTP transport always sends its own. The user
+// agent is a global setting, it must be changed within
+// WithGlobalSettings.
+func setUserAgent(userAgent string) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var cUserAgent *C.char
+	if userAgent != "" {
+		cUserAgent = C.CString(userAgent)
+		defer C.free(unsafe.Pointer(cUserAgent))
+	}
+	if rc := C.set_user_agent(cUserAgent); rc < 0 {
+		return fmt.Errorf("setting user agent: libgit2 error %d", rc)
+	}
+	return nil
+}
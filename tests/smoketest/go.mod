@@ -7,6 +7,7 @@ require (
 	github.com/fluxcd/pkg/ssh v0.3.2
 	github.com/fluxcd/source-controller v0.24.4
 	github.com/libgit2/git2go/v33 v33.0.9
+	github.com/prometheus/client_golang v1.12.1
 	golang.org/x/crypto v0.0.0-20220427172511-eb4f295cb31f
 )
 
@@ -108,7 +109,6 @@ require (
 	github.com/pkg/browser v0.0.0-20210115035449-ce105d075bb4 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/prometheus/client_golang v1.12.1 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
 	github.com/prometheus/common v0.32.1 // indirect
 	github.com/prometheus/procfs v0.7.3 // indirect
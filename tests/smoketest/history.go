@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fluxcd/source-controller/pkg/git"
+	git2go "github.com/libgit2/git2go/v33"
+)
+
+// SeedIdentity is the author and committer of the commits created by
+// seedRepoAs. Commit i is dated i seconds after Epoch.
+type SeedIdentity struct {
+	Name  string
+	Email string
+	Epoch time.Time
+}
+
+// defaultSeedIdentity is the identity of the commits of seedRepo,
+// "Seed <seed@example.com>", with commit i dated 1600000000+i seconds
+// since the Unix epoch, in UTC.
+var defaultSeedIdentity = SeedIdentity{
+	Name:  "Seed",
+	Email: "seed@example.com",
+	Epoch: time.Unix(1600000000, 0).UTC(),
+}
+
+// seedRepo creates a bare repository at path with commits commits
+// reachable from git.DefaultBranch, which HEAD points at. Commit i adds
+// the file commit-i. From three commits on, the last commit merges a
+// commit branched off the first one, the others form a single line.
+// Names, messages and dates are fixed, so the same commits are created
+// on every run.
+func seedRepo(path string, commits int) error {
+	return seedRepoAs(path, commits, defaultSeedIdentity)
+}
+
+// seedRepoAs creates the commits of seedRepo, with identity as their
+// author and committer.
+func seedRepoAs(path string, commits int, identity SeedIdentity) error {
+	if commits < 1 {
+		return fmt.Errorf("cannot seed a repository with %d commits", commits)
+	}
+	repo, err := git2go.InitRepository(path, true)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	first, err := seedCommitAs(repo, identity, 1)
+	if err != nil {
+		return err
+	}
+	defer first.Free()
+	head := first
+
+	line := commits
+	if commits >= 3 {
+		line = commits - 2
+	}
+	for i := 2; i <= line; i++ {
+		next, err := seedCommitAs(repo, identity, i, head)
+		if err != nil {
+			return err
+		}
+		defer next.Free()
+		head = next
+	}
+	if commits >= 3 {
+		side, err := seedCommitAs(repo, identity, commits-1, first)
+		if err != nil {
+			return err
+		}
+		defer side.Free()
+		merge, err := seedCommitAs(repo, identity, commits, head, side)
+		if err != nil {
+			return err
+		}
+		defer merge.Free()
+		head = merge
+	}
+
+	branch := "refs/heads/" + git.DefaultBranch
+	ref, err := repo.References.Create(branch, head.Id(), true, "seed")
+	if err != nil {
+		return err
+	}
+	ref.Free()
+	return repo.SetHead(branch)
+}
+
+// seedCommit creates commit i of seedRepo, with the tree of the first
+// of parents and the file commit-i.
+func seedCommit(repo *git2go.Repository, i int, parents ...*git2go.Commit) (*git2go.Commit, error) {
+	return seedCommitAs(repo, defaultSeedIdentity, i, parents...)
+}
+
+// seedCommitAs creates commit i of seedRepoAs, with identity as its
+// author and committer.
+func seedCommitAs(repo *git2go.Repository, identity SeedIdentity, i int, parents ...*git2go.Commit) (*git2go.Commit, error) {
+	var builder *git2go.TreeBuilder
+	var err error
+	if len(parents) > 0 {
+		tree, err := parents[0].Tree()
+		if err != nil {
+			return nil, err
+		}
+		defer tree.Free()
+		builder, err = repo.TreeBuilderFromTree(tree)
+	} else {
+		builder, err = repo.TreeBuilder()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer builder.Free()
+
+	blob, err := repo.CreateBlobFromBuffer([]byte(fmt.Sprintf("commit %d\n", i)))
+	if err != nil {
+		return nil, err
+	}
+	if err := builder.Insert(fmt.Sprintf("commit-%d", i), blob, git2go.FilemodeBlob); err != nil {
+		return nil, err
+	}
+	treeID, err := builder.Write()
+	if err != nil {
+		return nil, err
+	}
+	tree, err := repo.LookupTree(treeID)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	sig := &git2go.Signature{
+		Name:  identity.Name,
+		Email: identity.Email,
+		When:  identity.Epoch.Add(time.Duration(i) * time.Second),
+	}
+	id, err := repo.CreateCommit("", sig, sig, fmt.Sprintf("Commit %d", i), tree, parents...)
+	if err != nil {
+		return nil, err
+	}
+	return repo.LookupCommit(id)
+}
+
+// seedSubmodule is a submodule added by seedSubmodules, at path, of
+// the repository at url, with commit checked out.
+type seedSubmodule struct {
+	path   string
+	url    string
+	commit *git2go.Oid
+}
+
+// seedSubmodules commits submodules on top of git.DefaultBranch of the
+// bare repository at path, as gitlinks listed in .gitmodules.
+func seedSubmodules(path string, submodules []seedSubmodule) error {
+	repo, err := git2go.OpenRepository(path)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	branch := "refs/heads/" + git.DefaultBranch
+	ref, err := repo.References.Lookup(branch)
+	if err != nil {
+		return err
+	}
+	defer ref.Free()
+	head, err := repo.LookupCommit(ref.Target())
+	if err != nil {
+		return err
+	}
+	defer head.Free()
+	tree, err := head.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	builder, err := repo.TreeBuilderFromTree(tree)
+	if err != nil {
+		return err
+	}
+	defer builder.Free()
+
+	var gitmodules strings.Builder
+	for _, sm := range submodules {
+		fmt.Fprintf(&gitmodules, "[submodule %q]\n\tpath = %s\n\turl = %s\n", sm.path, sm.path, sm.url)
+		if err := builder.Insert(sm.path, sm.commit, git2go.FilemodeCommit); err != nil {
+			return err
+		}
+	}
+	blob, err := repo.CreateBlobFromBuffer([]byte(gitmodules.String()))
+	if err != nil {
+		return err
+	}
+	if err := builder.Insert(".gitmodules", blob, git2go.FilemodeBlob); err != nil {
+		return err
+	}
+	treeID, err := builder.Write()
+	if err != nil {
+		return err
+	}
+	newTree, err := repo.LookupTree(treeID)
+	if err != nil {
+		return err
+	}
+	defer newTree.Free()
+
+	sig := &git2go.Signature{
+		Name:  defaultSeedIdentity.Name,
+		Email: defaultSeedIdentity.Email,
+		When:  head.Committer().When.Add(time.Second),
+	}
+	_, err = repo.CreateCommit(branch, sig, sig, "Add submodules", newTree, head)
+	return err
+}
+
+// checkCommitCount returns an error if the number of commits reachable
+// from HEAD in repo is not want.
+func checkCommitCount(repo *git2go.Repository, want int) error {
+	walk, err := repo.Walk()
+	if err != nil {
+		return fmt.Errorf("creating revwalk: %w", err)
+	}
+	defer walk.Free()
+	if err := walk.PushHead(); err != nil {
+		return fmt.Errorf("pushing HEAD: %w", err)
+	}
+
+	var got int
+	if err := walk.Iterate(func(*git2go.Commit) bool {
+		got++
+		return true
+	}); err != nil {
+		return fmt.Errorf("walking history: %w", err)
+	}
+	if got != want {
+		return fmt.Errorf("expected %d commits reachable from HEAD, got %d", want, got)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fluxcd/golang-with-libgit2/tests/sample/gitclone"
+	"github.com/fluxcd/pkg/ssh"
+	git2go "github.com/libgit2/git2go/v33"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHostsSource provides the known hosts of a host in known_hosts
+// format, e.g. from a file, a config map, or a remote store. Entries
+// for other hosts are ignored.
+type KnownHostsSource interface {
+	// Get returns the known hosts of host, including the port if it is
+	// not the default one. It returns no entries for unknown hosts.
+	Get(host string) ([]byte, error)
+}
+
+// FileKnownHosts is a KnownHostsSource reading the known_hosts file at
+// its path on every Get.
+type FileKnownHosts string
+
+func (f FileKnownHosts) Get(string) ([]byte, error) {
+	return os.ReadFile(string(f))
+}
+
+// MemoryKnownHosts is a KnownHostsSource holding known_hosts entries in
+// memory, by host.
+type MemoryKnownHosts map[string][]byte
+
+func (m MemoryKnownHosts) Get(host string) ([]byte, error) {
+	return m[host], nil
+}
+
+// CachedKnownHosts is a KnownHostsSource getting the known hosts of
+// each host from Source once, and serving them from memory afterwards,
+// so that clones of the same host sharing it don't get them every time
+// they verify its key. Errors are not cached.
+type CachedKnownHosts struct {
+	Source KnownHostsSource
+
+	mu    sync.Mutex
+	hosts map[string][]byte
+}
+
+func (c *CachedKnownHosts) Get(host string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if knownHosts, ok := c.hosts[host]; ok {
+		return knownHosts, nil
+	}
+	knownHosts, err := c.Source.Get(host)
+	if err != nil {
+		return nil, err
+	}
+	if c.hosts == nil {
+		c.hosts = map[string][]byte{}
+	}
+	c.hosts[host] = knownHosts
+	return knownHosts, nil
+}
+
+// knownHostsSourceCallback returns a CertificateCheckCallback like
+// gitclone.KnownHostsCallback, which gets the known hosts of host from
+// source when it is called.
+func knownHostsSourceCallback(host string, source KnownHostsSource) git2go.CertificateCheckCallback {
+	return func(cert *git2go.Certificate, valid bool, hostname string) error {
+		knownHosts, err := source.Get(host)
+		if err != nil {
+			return fmt.Errorf("getting known hosts of %s: %w", host, err)
+		}
+		return gitclone.KnownHostsCallback(host, knownHosts)(cert, valid, hostname)
+	}
+}
+
+// StrictVerifier verifies SSH host keys against known_hosts files using
+// golang.org/x/crypto/ssh/knownhosts, as an alternative to
+// gitclone.KnownHostsCallback.
+//
+// Where gitclone.KnownHostsCallback only matches plain host names
+// against the SHA256 fingerprint of the host key, StrictVerifier also
+// supports hashed host names, wildcard and negated host patterns, and
+// @revoked markers. A revoked key is rejected even when another entry
+// for the host lists it. A host key which doesn't match the known keys
+// is reported as a *knownhosts.KeyError, a revoked key as a
+// *knownhosts.RevokedError. It requires libgit2 to provide the raw host
+// key rather than just its fingerprints.
+type StrictVerifier struct {
+	// IgnorePort makes the verifier match hosts on a non-standard port
+	// against the entries for the host without a port, as written by
+	// users connecting to the default port, if there is no entry for
+	// the host and port. Off by default, the port must match.
+	IgnorePort bool
+
+	hostKeyCallback cryptossh.HostKeyCallback
+
+	mu       sync.Mutex
+	tofu     bool
+	tofuFile string
+	// firstUse holds the keys trusted on first use, by normalized
+	// address.
+	firstUse map[string]cryptossh.PublicKey
+}
+
+// NewStrictVerifier returns a StrictVerifier for the known hosts in
+// the given known_hosts files. The files are read once, changes made
+// to them afterwards are not picked up.
+func NewStrictVerifier(files ...string) (*StrictVerifier, error) {
+	hostKeyCallback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+	return &StrictVerifier{hostKeyCallback: hostKeyCallback}, nil
+}
+
+// TrustOnFirstUse makes the verifier accept the key of a host which is
+// not in its known_hosts files the first time it sees the host, and
+// only that key afterwards. Trusted keys are appended to the
+// known_hosts file at file, unless it is empty. A host key which does
+// not match the known keys of a host is still rejected. Trust on first
+// use is off unless enabled with this.
+func (v *StrictVerifier) TrustOnFirstUse(file string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.tofu = true
+	v.tofuFile = file
+	if v.firstUse == nil {
+		v.firstUse = map[string]cryptossh.PublicKey{}
+	}
+}
+
+// Callback returns a CertificateCheckCallback that verifies the key of
+// the Git server against the given host, which must include the port
+// if the server does not listen on the default SSH port.
+func (v *StrictVerifier) Callback(host string) git2go.CertificateCheckCallback {
+	return func(cert *git2go.Certificate, valid bool, hostname string) error {
+		if cert == nil {
+			return fmt.Errorf("no certificate returned for %s", hostname)
+		}
+		if cert.Hostkey.Kind&git2go.HostkeyRaw == 0 || cert.Hostkey.SSHPublicKey == nil {
+			return fmt.Errorf("no raw host key returned for %s", hostname)
+		}
+
+		hostWithoutPort, port, err := net.SplitHostPort(host)
+		if err != nil {
+			hostWithoutPort, port = host, "22"
+		}
+		hostnameWithoutPort, _, err := net.SplitHostPort(hostname)
+		if err != nil {
+			hostnameWithoutPort = hostname
+		}
+		if hostnameWithoutPort != hostWithoutPort {
+			return fmt.Errorf("host mismatch: %q %q", hostnameWithoutPort, hostWithoutPort)
+		}
+
+		// The remote address is only used when no host name is given,
+		// but must be a TCP address regardless.
+		address := net.JoinHostPort(hostWithoutPort, port)
+		remote, err := net.ResolveTCPAddr("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			return err
+		}
+		return v.verify(address, remote, cert.Hostkey.SSHPublicKey)
+	}
+}
+
+func (v *StrictVerifier) verify(address string, remote net.Addr, key cryptossh.PublicKey) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	normalized := knownhosts.Normalize(address)
+	if trusted, ok := v.firstUse[normalized]; ok {
+		if bytes.Equal(trusted.Marshal(), key.Marshal()) {
+			return nil
+		}
+		return &knownhosts.KeyError{Want: []knownhosts.KnownKey{{Key: trusted, Filename: v.tofuFile}}}
+	}
+
+	err := v.hostKeyCallback(address, remote, key)
+	if v.IgnorePort && isUnknownHost(err) {
+		// Entries without a port are the ones for the default port.
+		host, _, splitErr := net.SplitHostPort(address)
+		if splitErr != nil {
+			return splitErr
+		}
+		err = v.hostKeyCallback(net.JoinHostPort(host, "22"), remote, key)
+	}
+	if !v.tofu || !isUnknownHost(err) {
+		return err
+	}
+	if v.tofuFile != "" {
+		line := knownhosts.Line([]string{normalized}, key) + "\n"
+		if err := appendFile(v.tofuFile, []byte(line)); err != nil {
+			return fmt.Errorf("recording host key of %s: %w", address, err)
+		}
+	}
+	v.firstUse[normalized] = key
+	return nil
+}
+
+// scanHostKeyUntil is ssh.ScanHostKey, with deadline enforced for the
+// whole SSH handshake. ssh.ScanHostKey only limits the time to connect,
+// and hangs on servers which accept connections but never answer.
+func scanHostKeyUntil(host string, deadline time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", host, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	collector := &ssh.HostKeyCollector{}
+	c, chans, reqs, err := cryptossh.NewClientConn(conn, host, &cryptossh.ClientConfig{
+		HostKeyCallback: collector.StoreKey(),
+	})
+	if err == nil {
+		cryptossh.NewClient(c, chans, reqs).Close()
+	}
+	// Authentication fails once the host key is collected.
+	if knownHosts := collector.GetKnownKeys(); len(knownHosts) > 0 {
+		return knownHosts, nil
+	}
+	return nil, err
+}
+
+// isUnknownHost returns true if err is the error of a
+// knownhosts.HostKeyCallback for a host without known keys, as opposed
+// to one known with other keys.
+func isUnknownHost(err error) bool {
+	var keyErr *knownhosts.KeyError
+	return errors.As(err, &keyErr) && len(keyErr.Want) == 0
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// printHostKey writes the host key of the SSH server at host to w in
+// known_hosts format, as scanned for the test server.
+func printHostKey(w io.Writer, host string) error {
+	knownHosts, err := scanHostKey(host, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("scan host key: %w", err)
+	}
+	_, err = w.Write(knownHosts)
+	return err
+}
+
+// scanHostKey returns the host key of host in known_hosts format, like
+// ssh.ScanHostKey. While host refuses connections, which happens when
+// the SSH server is not listening yet, it retries with backoff until
+// timeout has passed. Any other error is returned right away. It
+// returns once timeout has passed, even if host accepts connections but
+// never answers.
+func scanHostKey(host string, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := 50 * time.Millisecond
+	for {
+		knownHosts, err := scanHostKeyUntil(host, deadline)
+		if err == nil || !errors.Is(err, syscall.ECONNREFUSED) {
+			return knownHosts, err
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("%s still refusing connections after %s: %w", host, timeout, err)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+	}
+}
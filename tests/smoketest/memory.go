@@ -0,0 +1,71 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// MemoryStats holds the bytes of heap in use around a clone, as
+// reported by runtime.ReadMemStats. libgit2 allocates with malloc, its
+// own allocations are not included, only the ones made by git2go and
+// the callbacks.
+type MemoryStats struct {
+	// Before is the heap in use before the clone.
+	Before uint64
+	// After is the heap in use after the clone.
+	After uint64
+	// Peak is the most heap in use sampled during the clone, including
+	// Before and After.
+	Peak uint64
+}
+
+// memorySampler samples the heap in use periodically, from when it is
+// started by sampleMemory until stop is called.
+type memorySampler struct {
+	stats   MemoryStats
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// sampleMemory starts a memorySampler sampling every interval.
+// ReadMemStats stops the world, so sampling is only done when asked
+// for.
+func sampleMemory(interval time.Duration) *memorySampler {
+	s := &memorySampler{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	s.stats.Before = s.sample()
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sample()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// sample reads the heap in use, and records it as the peak if it is.
+func (s *memorySampler) sample() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > s.stats.Peak {
+		s.stats.Peak = m.HeapAlloc
+	}
+	return m.HeapAlloc
+}
+
+// stop stops sampling, and returns the stats sampled.
+func (s *memorySampler) stop() MemoryStats {
+	close(s.done)
+	<-s.stopped
+	s.stats.After = s.sample()
+	return s.stats
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/fluxcd/golang-with-libgit2/tests/sample/gitclone"
+	git2go "github.com/libgit2/git2go/v33"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CloneMetrics is a prometheus.Collector of metrics of the clones made
+// through its Clone method. Clones made with clone are not observed, so
+// nothing depends on Prometheus unless CloneMetrics is used.
+type CloneMetrics struct {
+	clones        prometheus.Counter
+	duration      prometheus.Histogram
+	receivedBytes prometheus.Counter
+	failures      *prometheus.CounterVec
+}
+
+// NewCloneMetrics returns CloneMetrics with metric names prefixed with
+// namespace.
+func NewCloneMetrics(namespace string) *CloneMetrics {
+	return &CloneMetrics{
+		clones: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "clones_total",
+			Help:      "Number of clones started.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "clone_duration_seconds",
+			Help:      "Duration of clones, including failed ones.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		}),
+		receivedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "clone_received_bytes_total",
+			Help:      "Bytes of packfile data received by clones.",
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "clone_failures_total",
+			Help:      "Number of failed clones, by reason.",
+		}, []string{"reason"}),
+	}
+}
+
+func (m *CloneMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.clones.Describe(ch)
+	m.duration.Describe(ch)
+	m.receivedBytes.Describe(ch)
+	m.failures.Describe(ch)
+}
+
+func (m *CloneMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.clones.Collect(ch)
+	m.duration.Collect(ch)
+	m.receivedBytes.Collect(ch)
+	m.failures.Collect(ch)
+}
+
+// Clone clones url into path like gitclone.CloneWith, and records the
+// clone in m.
+func (m *CloneMetrics) Clone(url, path string, options *git2go.CloneOptions) (*git2go.Repository, error) {
+	opts := *options
+	var received uint
+	transferProgress := opts.FetchOptions.RemoteCallbacks.TransferProgressCallback
+	opts.FetchOptions.RemoteCallbacks.TransferProgressCallback = func(stats git2go.TransferProgress) error {
+		received = stats.ReceivedBytes
+		if transferProgress != nil {
+			return transferProgress(stats)
+		}
+		return nil
+	}
+
+	m.clones.Inc()
+	start := time.Now()
+	repo, err := gitclone.CloneWith(url, path, &opts)
+	m.duration.Observe(time.Since(start).Seconds())
+	m.receivedBytes.Add(float64(received))
+	if err != nil {
+		m.failures.WithLabelValues(failureReason(err)).Inc()
+	}
+	return repo, err
+}
+
+// failureReason returns the reason label of the clone_failures_total
+// metric for the error of a clone.
+func failureReason(err error) string {
+	var gitErr *git2go.GitError
+	switch {
+	case errors.As(err, &gitErr) && gitErr.Code == git2go.ErrorCodeAuth:
+		return "auth"
+	case errors.As(err, &gitErr) && gitErr.Code == git2go.ErrorCodeCertificate:
+		return "certificate"
+	case isConnectionError(err):
+		return "connection"
+	case errors.Is(err, gitclone.ErrObjectTooLarge):
+		return "object_too_large"
+	default:
+		return "other"
+	}
+}
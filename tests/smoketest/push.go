@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fluxcd/golang-with-libgit2/tests/sample/gitclone"
+	git2go "github.com/libgit2/git2go/v33"
+)
+
+// pushRefs pushes refspecs to the remote named remoteName of repo, and
+// returns the status reported by the server for each remote ref it
+// updated or rejected. The status of an updated ref is empty, the one
+// of a rejected ref is the reason given by the server. A rejected ref
+// does not fail the push, an error is only returned if the push as a
+// whole failed.
+//
+// libgit2 does not support signed pushes, so no push certificate can
+// be requested from the server.
+func pushRefs(repo *git2go.Repository, remoteName string, refspecs []string, callbacks git2go.RemoteCallbacks) (map[string]string, error) {
+	remote, err := repo.Remotes.Lookup(remoteName)
+	if err != nil {
+		return nil, fmt.Errorf("looking up remote %s: %w", remoteName, err)
+	}
+	defer remote.Free()
+
+	statuses := map[string]string{}
+	pushUpdateReference := callbacks.PushUpdateReferenceCallback
+	callbacks.PushUpdateReferenceCallback = func(refname, status string) error {
+		statuses[refname] = status
+		if pushUpdateReference != nil {
+			return pushUpdateReference(refname, status)
+		}
+		return nil
+	}
+	if err := remote.Push(refspecs, &git2go.PushOptions{RemoteCallbacks: callbacks}); err != nil {
+		return statuses, gitclone.RedactError(err)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	git2go "github.com/libgit2/git2go/v33"
+)
+
+// repack packs the objects reachable from the references of repo into
+// a single packfile, and deletes the packfiles and loose objects it had
+// before, like git repack -a -d followed by git prune. It is meant to
+// be run after cloning long-lived mirrors, to keep fetches from piling
+// up packfiles.
+//
+// libgit2 has no gc or repack, so this builds the packfile with its
+// packbuilder. The objects pointed at by references, through annotated
+// tags if any, and the objects reachable from them, are packed.
+func repack(repo *git2go.Repository) error {
+	pb, err := repo.NewPackbuilder()
+	if err != nil {
+		return err
+	}
+	defer pb.Free()
+	if err := insertReachable(repo, pb); err != nil {
+		return err
+	}
+
+	// The packfile is written aside first, as it has the name of an old
+	// one if it has the same objects.
+	objectsDir := filepath.Join(repo.Path(), "objects")
+	packDir := filepath.Join(objectsDir, "pack")
+	tmpDir, err := os.MkdirTemp(packDir, "repack-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := pb.WriteToFile(tmpDir, 0o444); err != nil {
+		return fmt.Errorf("writing packfile: %w", err)
+	}
+
+	old, err := filepath.Glob(filepath.Join(packDir, "pack-*"))
+	if err != nil {
+		return err
+	}
+	// The new packfile is moved in before the old ones are removed, so
+	// that the objects stay available if this fails half-way. The index
+	// is moved last, libgit2 only loads packfiles with an index.
+	written := map[string]bool{}
+	for _, ext := range []string{".pack", ".idx"} {
+		paths, err := filepath.Glob(filepath.Join(tmpDir, "pack-*"+ext))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			name := filepath.Base(path)
+			if err := os.Rename(path, filepath.Join(packDir, name)); err != nil {
+				return err
+			}
+			written[name] = true
+		}
+	}
+	for _, path := range old {
+		if written[filepath.Base(path)] {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if err := removeLooseObjects(objectsDir); err != nil {
+		return err
+	}
+
+	odb, err := repo.Odb()
+	if err != nil {
+		return err
+	}
+	defer odb.Free()
+	return odb.Refresh()
+}
+
+// insertReachable inserts the objects reachable from the references of
+// repo into pb.
+func insertReachable(repo *git2go.Repository, pb *git2go.Packbuilder) error {
+	walk, err := repo.Walk()
+	if err != nil {
+		return err
+	}
+	defer walk.Free()
+
+	iter, err := repo.NewReferenceIterator()
+	if err != nil {
+		return err
+	}
+	defer iter.Free()
+	for {
+		ref, err := iter.Next()
+		if git2go.IsErrorCode(err, git2go.ErrorCodeIterOver) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = insertReference(repo, pb, walk, ref)
+		ref.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return pb.InsertWalk(walk)
+}
+
+// insertReference pushes the commit ref points at to walk, and inserts
+// the annotated tags it points at, if any, into pb. Trees and blobs ref
+// points at are inserted into pb along with the objects they
+// reference.
+func insertReference(repo *git2go.Repository, pb *git2go.Packbuilder, walk *git2go.RevWalk, ref *git2go.Reference) error {
+	if ref.Type() == git2go.ReferenceSymbolic {
+		// The reference it points at is packed on its own.
+		return nil
+	}
+	obj, err := repo.Lookup(ref.Target())
+	if err != nil {
+		return fmt.Errorf("looking up %s: %w", ref.Name(), err)
+	}
+	for obj.Type() == git2go.ObjectTag {
+		if err := pb.Insert(obj.Id(), ""); err != nil {
+			obj.Free()
+			return err
+		}
+		tag, err := obj.AsTag()
+		obj.Free()
+		if err != nil {
+			return err
+		}
+		target := tag.TargetId()
+		tag.Free()
+		if obj, err = repo.Lookup(target); err != nil {
+			return fmt.Errorf("looking up the target of %s: %w", ref.Name(), err)
+		}
+	}
+	defer obj.Free()
+
+	switch obj.Type() {
+	case git2go.ObjectCommit:
+		return walk.Push(obj.Id())
+	case git2go.ObjectTree:
+		return pb.InsertTree(obj.Id())
+	default:
+		return pb.Insert(obj.Id(), "")
+	}
+}
+
+// looseObjectDir matches the directories of loose objects.
+var looseObjectDir = regexp.MustCompile(`^[0-9a-f]{2}$`)
+
+// removeLooseObjects deletes the loose objects of objectsDir.
+func removeLooseObjects(objectsDir string) error {
+	entries, err := os.ReadDir(objectsDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && looseObjectDir.MatchString(entry.Name()) {
+			if err := os.RemoveAll(filepath.Join(objectsDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
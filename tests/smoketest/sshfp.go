@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+
+	git2go "github.com/libgit2/git2go/v33"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// SSHFP algorithm numbers of the key types, from RFC 4255, RFC 6594 and
+// RFC 7479.
+var sshfpAlgorithms = map[string]uint8{
+	cryptossh.KeyAlgoRSA:      1,
+	cryptossh.KeyAlgoDSA:      2,
+	cryptossh.KeyAlgoECDSA256: 3,
+	cryptossh.KeyAlgoECDSA384: 3,
+	cryptossh.KeyAlgoECDSA521: 3,
+	cryptossh.KeyAlgoED25519:  4,
+}
+
+// SSHFP fingerprint types.
+const (
+	sshfpSHA1   uint8 = 1
+	sshfpSHA256 uint8 = 2
+)
+
+// SSHFPRecord is a DNS SSHFP resource record.
+type SSHFPRecord struct {
+	Algorithm       uint8
+	FingerprintType uint8
+	Fingerprint     []byte
+}
+
+// SSHFPResolver looks up the SSHFP records of a host. Records are only
+// as trustworthy as the resolver, which must only return records
+// validated with DNSSEC.
+type SSHFPResolver interface {
+	LookupSSHFP(host string) ([]SSHFPRecord, error)
+}
+
+// errNoSSHFPRecords is returned by the callback of SSHFPVerifier for
+// hosts without SSHFP records.
+var errNoSSHFPRecords = errors.New("no SSHFP records")
+
+// SSHFPVerifier verifies SSH host keys against the SSHFP records of the
+// host, as an alternative to known_hosts files.
+type SSHFPVerifier struct {
+	Resolver SSHFPResolver
+}
+
+// Callback returns a CertificateCheckCallback that verifies the key of
+// the Git server against the SSHFP records of host. The port of host,
+// if any, is ignored, SSHFP records are per host name.
+func (v *SSHFPVerifier) Callback(host string) git2go.CertificateCheckCallback {
+	return func(cert *git2go.Certificate, valid bool, hostname string) error {
+		if cert == nil {
+			return fmt.Errorf("no certificate returned for %s", hostname)
+		}
+		if cert.Hostkey.Kind&git2go.HostkeyRaw == 0 || cert.Hostkey.SSHPublicKey == nil {
+			return fmt.Errorf("no raw host key returned for %s", hostname)
+		}
+
+		hostWithoutPort, _, err := net.SplitHostPort(host)
+		if err != nil {
+			hostWithoutPort = host
+		}
+		hostnameWithoutPort, _, err := net.SplitHostPort(hostname)
+		if err != nil {
+			hostnameWithoutPort = hostname
+		}
+		if hostnameWithoutPort != hostWithoutPort {
+			return fmt.Errorf("host mismatch: %q %q", hostnameWithoutPort, hostWithoutPort)
+		}
+
+		records, err := v.Resolver.LookupSSHFP(hostWithoutPort)
+		if err != nil {
+			return fmt.Errorf("looking up SSHFP records of %s: %w", hostWithoutPort, err)
+		}
+		if len(records) == 0 {
+			return fmt.Errorf("%w for %s", errNoSSHFPRecords, hostWithoutPort)
+		}
+		key := cert.Hostkey.SSHPublicKey
+		if sshfpMatches(records, key) {
+			return nil
+		}
+		return fmt.Errorf("hostkey cannot be verified: %s offered %s, which matches none of its %d SSHFP records",
+			hostWithoutPort, cryptossh.FingerprintSHA256(key), len(records))
+	}
+}
+
+// sshfpMatches returns true if any of records is of key.
+func sshfpMatches(records []SSHFPRecord, key cryptossh.PublicKey) bool {
+	algorithm, ok := sshfpAlgorithms[key.Type()]
+	if !ok {
+		return false
+	}
+	marshaled := key.Marshal()
+	sha1Sum, sha256Sum := sha1.Sum(marshaled), sha256.Sum256(marshaled)
+	for _, r := range records {
+		if r.Algorithm != algorithm {
+			continue
+		}
+		switch r.FingerprintType {
+		case sshfpSHA1:
+			if bytes.Equal(r.Fingerprint, sha1Sum[:]) {
+				return true
+			}
+		case sshfpSHA256:
+			if bytes.Equal(r.Fingerprint, sha256Sum[:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/fluxcd/golang-with-libgit2/tests/sample/gitclone"
+	git2go "github.com/libgit2/git2go/v33"
+)
+
+// TraceEvent is a point in the lifecycle of a clone traced by
+// cloneTraced.
+type TraceEvent string
+
+const (
+	// TraceConnect is when the remote is created, right before libgit2
+	// connects to it.
+	TraceConnect TraceEvent = "connect"
+	// TraceAuth is when credentials are asked for, which may happen
+	// several times.
+	TraceAuth TraceEvent = "auth"
+	// TraceHostKeyCheck is when the certificate or host key of the
+	// server is checked, which may happen several times.
+	TraceHostKeyCheck TraceEvent = "host-key-check"
+	// TraceNegotiation is when the server first reports progress, or
+	// starts sending the packfile if it does not, which is once the
+	// objects to send have been negotiated.
+	TraceNegotiation TraceEvent = "negotiation"
+	// TraceTransferStart is when the first of the packfile is received.
+	TraceTransferStart TraceEvent = "transfer-start"
+	// TraceTransferDone is when all objects of the packfile are
+	// received and indexed.
+	TraceTransferDone TraceEvent = "transfer-done"
+	// TraceCheckoutDone is when the working tree is checked out. Bare
+	// clones do not have it.
+	TraceCheckoutDone TraceEvent = "checkout-done"
+)
+
+// CloneTracer is told about the lifecycle of clones made by
+// cloneTraced, e.g. to log or time them.
+type CloneTracer interface {
+	Trace(event TraceEvent)
+}
+
+// cloneTraced clones url into path like gitclone.CloneWith, and calls
+// tracer at each TraceEvent of the clone, in the order above. Events
+// other than TraceAuth and TraceHostKeyCheck are only traced once. The
+// callbacks of options are still called.
+func cloneTraced(url, path string, options *git2go.CloneOptions, tracer CloneTracer) (*git2go.Repository, error) {
+	opts := git2go.CloneOptions{}
+	if options != nil {
+		opts = *options
+	}
+	t := &cloneTrace{tracer: tracer, traced: map[TraceEvent]bool{}}
+
+	createRemote := opts.RemoteCreateCallback
+	opts.RemoteCreateCallback = func(repo *git2go.Repository, name, url string) (*git2go.Remote, error) {
+		t.once(TraceConnect)
+		if createRemote != nil {
+			return createRemote(repo, name, url)
+		}
+		return repo.Remotes.Create(name, url)
+	}
+
+	callbacks := &opts.FetchOptions.RemoteCallbacks
+	credentials := callbacks.CredentialsCallback
+	if credentials != nil {
+		callbacks.CredentialsCallback = func(url, username string, allowed git2go.CredentialType) (*git2go.Credential, error) {
+			t.tracer.Trace(TraceAuth)
+			return credentials(url, username, allowed)
+		}
+	}
+	certificateCheck := callbacks.CertificateCheckCallback
+	if certificateCheck != nil {
+		callbacks.CertificateCheckCallback = func(cert *git2go.Certificate, valid bool, hostname string) error {
+			t.tracer.Trace(TraceHostKeyCheck)
+			return certificateCheck(cert, valid, hostname)
+		}
+	}
+	sidebandProgress := callbacks.SidebandProgressCallback
+	callbacks.SidebandProgressCallback = func(str string) error {
+		t.once(TraceNegotiation)
+		if sidebandProgress != nil {
+			return sidebandProgress(str)
+		}
+		return nil
+	}
+	transferProgress := callbacks.TransferProgressCallback
+	callbacks.TransferProgressCallback = func(stats git2go.TransferProgress) error {
+		t.once(TraceNegotiation)
+		t.once(TraceTransferStart)
+		if stats.TotalObjects > 0 && stats.IndexedObjects == stats.TotalObjects {
+			t.once(TraceTransferDone)
+		}
+		if transferProgress != nil {
+			return transferProgress(stats)
+		}
+		return nil
+	}
+
+	repo, err := gitclone.CloneWith(url, path, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Bare {
+		t.once(TraceCheckoutDone)
+	}
+	return repo, nil
+}
+
+// cloneTrace calls a CloneTracer for the events of a clone.
+type cloneTrace struct {
+	tracer CloneTracer
+
+	mu     sync.Mutex
+	traced map[TraceEvent]bool
+}
+
+// once traces event unless it was traced already.
+func (t *cloneTrace) once(event TraceEvent) {
+	t.mu.Lock()
+	traced := t.traced[event]
+	t.traced[event] = true
+	t.mu.Unlock()
+	if !traced {
+		t.tracer.Trace(event)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fluxcd/golang-with-libgit2/tests/sample/gitclone"
+	git2go "github.com/libgit2/git2go/v33"
+)
+
+// withHTTPTransport runs fn with a managed smart transport registered
+// for protocol, which sends all requests through roundTripper.
+func withHTTPTransport(protocol string, roundTripper http.RoundTripper, fn func() error) error {
+	return withHTTPClient(protocol, &http.Client{Transport: roundTripper}, fn)
+}
+
+// errTooManyRedirects is returned for requests redirected more often
+// than allowed by maxRedirects.
+var errTooManyRedirects = errors.New("too many redirects")
+
+// maxRedirects returns a CheckRedirect function for an http.Client,
+// which fails requests redirected more than max times with
+// errTooManyRedirects, e.g. because of a redirect loop.
+func maxRedirects(max int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return fmt.Errorf("%w: stopped after %d redirects", errTooManyRedirects, max)
+		}
+		return nil
+	}
+}
+
+// withHTTPClient runs fn with a managed smart transport registered for
+// protocol, which sends all requests with client.
+func withHTTPClient(protocol string, client *http.Client, fn func() error) error {
+	return gitclone.WithSmartTransport(protocol, true, func(_ *git2go.Remote, transport *git2go.Transport) (git2go.SmartSubtransport, error) {
+		return &roundTripSubtransport{transport: transport, client: client}, nil
+	}, fn)
+}
+
+// withTLSVersions runs fn with HTTPS connections restricted to the TLS
+// versions from min to max, with server certificates verified against
+// roots. libgit2 does not expose the TLS versions it negotiates, so
+// this registers a transport with withHTTPTransport, and the
+// CertificateCheckCallback of the clone is not called.
+func withTLSVersions(min, max uint16, roots *x509.CertPool, fn func() error) error {
+	return withHTTPTransport("https", &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion: min,
+			MaxVersion: max,
+			RootCAs:    roots,
+		},
+	}, fn)
+}
+
+// withIPFamily runs fn with connections for protocol, "http" or
+// "https", restricted to network, "tcp4" for IPv4 or "tcp6" for IPv6, for hosts with
+// addresses of both families when one of them is broken. libgit2 has no
+// such option, so this registers a transport with withHTTPTransport.
+func withIPFamily(protocol, network string, fn func() error) error {
+	if network != "tcp4" && network != "tcp6" {
+		return fmt.Errorf("unknown IP network %q", network)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, fmt.Errorf("dialing %s over %s: %w", addr, network, err)
+			}
+			return conn, nil
+		},
+	}
+	return withHTTPTransport(protocol, transport, fn)
+}
+
+// KeepAliveOptions keep connections of clones from silently stalling
+// behind NATs and firewalls dropping idle connections, and limit the
+// time to connect separately from the time to transfer, so that
+// unreachable hosts fail fast while slow transfers still go on as long
+// as data flows. libgit2 has no such options, so they are applied by
+// the transport registered by withKeepAlive.
+type KeepAliveOptions struct {
+	// ConnectTimeout limits the time to establish each connection, 30
+	// seconds if zero. It does not limit the transfer.
+	ConnectTimeout time.Duration
+	// KeepAlive is the interval between TCP keep-alive probes. Keep-alive
+	// is disabled if negative, and uses the default of net.Dialer if
+	// zero.
+	KeepAlive time.Duration
+	// IdleTimeout fails connections on which nothing could be read or
+	// written for that long, there is no timeout if zero. Transfers
+	// taking longer are not failed as long as data flows.
+	IdleTimeout time.Duration
+	// Dial connects with dialer, which is configured with the options,
+	// dialer.DialContext is used if nil.
+	Dial func(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error)
+}
+
+// withKeepAlive runs fn with connections for protocol, "http" or
+// "https", dialed with options. It registers a transport with
+// withHTTPTransport.
+func withKeepAlive(protocol string, options KeepAliveOptions, fn func() error) error {
+	connectTimeout := options.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = 30 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: options.KeepAlive}
+	dial := options.Dial
+	if dial == nil {
+		dial = func(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+		defer cancel()
+		conn, err := dial(ctx, dialer, network, addr)
+		if err != nil || options.IdleTimeout <= 0 {
+			return conn, err
+		}
+		return &idleTimeoutConn{Conn: conn, timeout: options.IdleTimeout}, nil
+	}
+	return withHTTPTransport(protocol, transport, fn)
+}
+
+// idleTimeoutConn is a net.Conn extending its deadline by timeout
+// before every read and write.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// roundTripSubtransport is a git2go.SmartSubtransport speaking the
+// smart HTTP protocol through an http.Client.
+type roundTripSubtransport struct {
+	transport *git2go.Transport
+	client    *http.Client
+}
+
+func (t *roundTripSubtransport) Action(url string, action git2go.SmartServiceAction) (git2go.SmartSubtransportStream, error) {
+	s := &roundTripStream{owner: t, method: http.MethodPost}
+	switch action {
+	case git2go.SmartServiceActionUploadpackLs:
+		s.method, s.url = http.MethodGet, url+"/info/refs?service=git-upload-pack"
+	case git2go.SmartServiceActionUploadpack:
+		s.url, s.contentType = url+"/git-upload-pack", "application/x-git-upload-pack-request"
+	case git2go.SmartServiceActionReceivepackLs:
+		s.method, s.url = http.MethodGet, url+"/info/refs?service=git-receive-pack"
+	case git2go.SmartServiceActionReceivepack:
+		s.url, s.contentType = url+"/git-receive-pack", "application/x-git-receive-pack-request"
+	default:
+		return nil, fmt.Errorf("unknown action %d", action)
+	}
+	return s, nil
+}
+
+func (t *roundTripSubtransport) Close() error {
+	return nil
+}
+
+func (t *roundTripSubtransport) Free() {
+	t.client = nil
+}
+
+// roundTripStream buffers what libgit2 writes to it, and sends it as
+// the request body on the first read.
+type roundTripStream struct {
+	owner       *roundTripSubtransport
+	method      string
+	url         string
+	contentType string
+	body        bytes.Buffer
+	resp        *http.Response
+}
+
+func (s *roundTripStream) Write(p []byte) (int, error) {
+	if s.resp != nil {
+		return 0, errors.New("write after the request was sent")
+	}
+	return s.body.Write(p)
+}
+
+func (s *roundTripStream) Read(p []byte) (int, error) {
+	if s.resp == nil {
+		resp, err := s.send()
+		if err != nil {
+			return 0, err
+		}
+		s.resp = resp
+	}
+	return s.resp.Body.Read(p)
+}
+
+func (s *roundTripStream) send() (*http.Response, error) {
+	var username, password string
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(s.method, s.url, bytes.NewReader(s.body.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		if s.contentType != "" {
+			req.Header.Set("Content-Type", s.contentType)
+		}
+		if attempt > 0 {
+			req.SetBasicAuth(username, password)
+		}
+
+		resp, err := s.owner.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if username, password, err = s.credentials(); err != nil {
+				return nil, err
+			}
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+		}
+	}
+}
+
+func (s *roundTripStream) credentials() (string, string, error) {
+	cred, err := s.owner.transport.SmartCredentials("", git2go.CredentialTypeUserpassPlaintext)
+	if err != nil {
+		return "", "", err
+	}
+	defer cred.Free()
+	return cred.GetUserpassPlaintext()
+}
+
+func (s *roundTripStream) Free() {
+	if s.resp != nil {
+		// libgit2 stops reading at the end of the smart protocol data,
+		// the connection is only reused if the body is read to EOF.
+		io.Copy(io.Discard, s.resp.Body)
+		s.resp.Body.Close()
+	}
+}
+
+// resolvingDial returns a Dial function for SSHOptions connecting to
+// the IP addresses in hosts instead of resolving the host names they
+// are keyed by, like /etc/hosts entries for clones only, e.g. to reach
+// a server by its IP while still verifying the host key of its host
+// name. Other hosts are resolved as usual.
+func resolvingDial(hosts map[string]string) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip, ok := hosts[host]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+		return net.Dial(network, addr)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	git2go "github.com/libgit2/git2go/v33"
+)
+
+// x509ChainCallback returns a CertificateCheckCallback that verifies
+// the certificate of an HTTPS server chains up to one of the given
+// roots, and is valid for the host name.
+//
+// libgit2 only passes the leaf certificate to the callback, so the
+// intermediates sent by the server are not available for building the
+// chain and have to be provided as intermediates instead.
+func x509ChainCallback(roots, intermediates *x509.CertPool) git2go.CertificateCheckCallback {
+	return func(cert *git2go.Certificate, valid bool, hostname string) error {
+		if cert == nil || cert.Kind != git2go.CertificateX509 || cert.X509 == nil {
+			return fmt.Errorf("no X.509 certificate returned for %s", hostname)
+		}
+		_, err := cert.X509.Verify(x509.VerifyOptions{
+			DNSName:       hostname,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
+
+// certChain is a root CA, an intermediate CA signed by the root, and a
+// leaf certificate for 127.0.0.1 signed by the intermediate, all PEM
+// encoded.
+type certChain struct {
+	root, intermediate, leaf, leafKey []byte
+}
+
+func newCertChain() (*certChain, error) {
+	rootKey, root, rootPEM, err := newCert(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "smoketest root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("root: %w", err)
+	}
+	intermediateKey, intermediate, intermediatePEM, err := newCert(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "smoketest intermediate CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, root, rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("intermediate: %w", err)
+	}
+	leafKey, _, leafPEM, err := newCert(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, intermediate, intermediateKey)
+	if err != nil {
+		return nil, fmt.Errorf("leaf: %w", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		return nil, fmt.Errorf("leaf key: %w", err)
+	}
+	return &certChain{
+		root:         rootPEM,
+		intermediate: intermediatePEM,
+		leaf:         leafPEM,
+		leafKey:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+	}, nil
+}
+
+// newCert generates a key and a certificate from template signed by
+// parent, or self-signed if parent is nil.
+func newCert(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}